@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -25,9 +28,34 @@ var (
 	maxlife     int
 	waittimeout int
 	debug       bool
+	user        string
+	passfile    string
+	usersfile   string
+	prefill     int
+	database    string
+	charset     int
+	sslOption   proxy.TLSOption
+	listen      string
+	tlsCert     string
+	tlsKey      string
+	allow       string
+	peerpart    bool
+	sockOwner   string
+	sockGroup   string
+	sockMode    string
+	sockMkdir   bool
+	reset       string
+	txabort     string
+	poolmode    string
+	stmtcache   int
+	compress    string
+	localInfile bool
+	queryAttrs  string
 )
 
 const (
+	passwordEnv = "UMYPROXY_PASSWORD"
+
 	logstr = `
    __  ____  ___      ____
   / / / /  |/  /_  __/ __ \_________  _  ____  __
@@ -47,6 +75,45 @@ func init() {
 	flag.IntVar(&maxlife, "life", 3600, "mysql connection max life time")
 	flag.IntVar(&waittimeout, "wait", 3000, "wait mysql connection timeout")
 	flag.BoolVar(&debug, "debug", false, "set debug mode")
+	flag.StringVar(&user, "user", "", "mysql user managed by proxy, client auth is passed through when empty")
+	flag.StringVar(&passfile, "password-file", "", "mysql password file, default read from env "+passwordEnv)
+	flag.StringVar(&usersfile, "users", "", "client users file, one user:password or user:*<native hash> per line, also used without -user")
+	flag.IntVar(&prefill, "prefill", 0, "number of mysql connections opened at start (requires -user)")
+	flag.StringVar(&database, "database", "", "database of prefilled connections")
+	flag.IntVar(&charset, "charset", 45, "charset id of prefilled connections")
+	flag.StringVar(&sslOption.Mode, "ssl-mode", proxy.SSLModeDisabled, "ssl mode to mysql: disabled, preferred, required, verify_ca, verify_identity")
+	flag.StringVar(&sslOption.CA, "ssl-ca", "", "ssl ca file to verify mysql server")
+	flag.StringVar(&sslOption.Cert, "ssl-cert", "", "ssl client certificate file")
+	flag.StringVar(&sslOption.Key, "ssl-key", "", "ssl client key file")
+	flag.StringVar(&sslOption.ServerName, "ssl-server-name", "", "server name to verify, default is host")
+	flag.StringVar(&listen, "listen", "", "also listen on tcp address, e.g. 127.0.0.1:3307")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file for client tls")
+	flag.StringVar(&tlsKey, "tls-key", "", "key file for client tls")
+	flag.StringVar(&allow, "allow", "", "unix socket peers allowed to connect, e.g. gid:www-data,uid:1000,pid:1234")
+	flag.BoolVar(&peerpart, "peer-partition", false, "partition pool by unix socket peer uid")
+	flag.StringVar(&sockOwner, "socket-owner", "", "socket file owner, user name or uid")
+	flag.StringVar(&sockGroup, "socket-group", "", "socket file group, group name or gid")
+	flag.StringVar(&sockMode, "socket-mode", "0777", "socket file mode")
+	flag.BoolVar(&sockMkdir, "socket-mkdir", false, "create socket file directory if not exists")
+	flag.StringVar(&compress, "compress", proxy.CompressNone, "compression with mysql: none, zlib")
+	flag.StringVar(&poolmode, "mode", proxy.PoolModeSession, "pool mode: session, transaction")
+	flag.IntVar(&stmtcache, "stmt-cache", proxy.DefaultStmtCacheSize, "prepared statements cached per mysql conn in transaction mode")
+	flag.BoolVar(&localInfile, "local-infile", true, "allow LOAD DATA LOCAL INFILE")
+	flag.StringVar(&queryAttrs, "query-attrs", "", "query attributes sent to mysql with COM_QUERY and COM_STMT_EXECUTE, e.g. app=web,region=us")
+	flag.StringVar(&txabort, "tx-abort", proxy.TxAbortRollback, "when client disconnects in transaction: rollback, close")
+	flag.StringVar(&reset, "reset", proxy.ResetConnection, "reset session before conn returns to pool: none, reset, change_user (requires -user)")
+}
+
+// 从文件或环境变量读取 mysql 密码
+func readPassword() ([]byte, error) {
+	if passfile == "" {
+		return []byte(os.Getenv(passwordEnv)), nil
+	}
+	data, err := ioutil.ReadFile(passfile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, "\r\n"), nil
 }
 
 func main() {
@@ -65,12 +132,91 @@ func main() {
 		MaxLifetime: time.Second * time.Duration(maxlife),
 		PoolMaxSize: poolsize,
 		WaitTimeout: time.Millisecond * time.Duration(waittimeout),
+		User:        user,
+		Prefill:     prefill,
+		Database:    database,
+		Charset:     uint8(charset),
+
+		PeerPartition: peerpart,
+		Reset:         reset,
+		Mode:          poolmode,
+		StmtCacheSize: stmtcache,
+	}
+	if poolmode != proxy.PoolModeSession && poolmode != proxy.PoolModeTransaction {
+		log.Fatalln("unknown -mode:", poolmode)
+	}
+	if txabort != proxy.TxAbortRollback && txabort != proxy.TxAbortClose {
+		log.Fatalln("unknown -tx-abort:", txabort)
+	}
+	if reset == proxy.ResetChangeUser && user == "" {
+		log.Fatalln("-reset change_user requires -user")
+	}
+	if user != "" {
+		password, err := readPassword()
+		if err != nil {
+			log.Fatalln("read password err:", err)
+		}
+		option.Password = password
+		if usersfile == "" {
+			log.Fatalln("-users is required with -user")
+		}
 	}
 
-	p := proxy.NewProxy(proxy.NewPool(option), socketfile)
+	pool := proxy.NewPool(option)
+	creater, err := proxy.NewTLSConnect(sslOption, host)
+	if err != nil {
+		log.Fatalln("ssl config err:", err)
+	}
+	creater, err = proxy.NewCompressConnect(creater, compress)
+	if err != nil {
+		log.Fatalln("compress err:", err)
+	}
+	pool.SetCreater(creater)
+
+	p := proxy.NewProxy(pool, socketfile)
 	if debug {
 		p.SetDebug()
 	}
+	if listen != "" {
+		p.SetListen(listen)
+	}
+	mode, err := strconv.ParseUint(sockMode, 8, 32)
+	if err != nil {
+		log.Fatalln("socket mode err:", err)
+	}
+	p.SetSocketOption(proxy.SocketOption{Owner: sockOwner, Group: sockGroup, Mode: os.FileMode(mode), MkdirAll: sockMkdir})
+	p.SetTxAbort(txabort)
+	if !localInfile {
+		p.RefuseLocalInfile()
+	}
+	if queryAttrs != "" {
+		attrs, err := proxy.ParseQueryAttributes(queryAttrs)
+		if err != nil {
+			log.Fatalln("query attributes err:", err)
+		}
+		p.SetQueryAttributes(attrs)
+	}
+	if allow != "" {
+		peerAllow, err := proxy.ParsePeerAllow(allow)
+		if err != nil {
+			log.Fatalln("allow rules err:", err)
+		}
+		p.SetPeerAllow(peerAllow)
+	}
+	if tlsCert != "" {
+		config, err := proxy.NewServerTLSConfig(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalln("tls config err:", err)
+		}
+		p.SetTLS(config)
+	}
+	if usersfile != "" {
+		users, err := proxy.LoadUsers(usersfile)
+		if err != nil {
+			log.Fatalln("load users err:", err)
+		}
+		p.SetUsers(users)
+	}
 
 	processed := make(chan struct{})
 	go func() {
@@ -85,7 +231,9 @@ func main() {
 		close(processed)
 	}()
 
-	p.Run()
+	if err := p.Run(); err != nil {
+		log.Fatalln("run err:", err)
+	}
 
 	<-processed
 	log.Println("exit")
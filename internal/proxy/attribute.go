@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lyuangg/umyproxy/protocol"
+)
+
+// 解析 name=value 格式的 query attributes, 多个用逗号分隔
+func ParseQueryAttributes(s string) (protocol.QueryAttributes, error) {
+	attrs := protocol.QueryAttributes{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.Index(item, "=")
+		if idx <= 0 {
+			return attrs, fmt.Errorf("invalid query attribute: %s", item)
+		}
+		attrs = attrs.Set(protocol.StringAttribute(item[:idx], item[idx+1:]))
+	}
+	return attrs, nil
+}
+
+// 设置代理发给 mysql 的 query attributes, 加在每个 COM_QUERY 和 COM_STMT_EXECUTE 中
+// mysql 连接总是协商 CLIENT_QUERY_ATTRIBUTES, 与客户端的 attribute 同名时使用代理的值
+func (p *Proxy) SetQueryAttributes(attrs protocol.QueryAttributes) {
+	p.queryAttrs = attrs
+	p.pool.option.QueryAttributes = len(attrs) > 0
+}
+
+// 读取客户端 COM_QUERY 和 COM_STMT_EXECUTE 中的 query attributes 记录在 session.Attributes,
+// 加上代理的 attributes 后按 mysql 连接的 capability 编码
+// 客户端没有协商 CLIENT_QUERY_ATTRIBUTES 而 mysql 连接协商了时, 需要转换格式
+// longData 时执行包中缺少参数值, 不能解析
+func (p *Proxy) queryAttributes(session *protocol.Session, server protocol.Connector, cmd protocol.Packet, longData bool) (protocol.Packet, error) {
+	capability := protocol.ConnCapability(server)
+	if cmd.Command() == protocol.COM_STMT_EXECUTE {
+		// transaction 模式下的虚拟语句已经转换过
+		id, _ := protocol.StatementId(cmd)
+		if params, ok := session.StatementParams(id); ok {
+			return p.executeAttributes(session, cmd, params, capability, longData)
+		}
+		return cmd, nil
+	}
+	if cmd.Command() != protocol.COM_QUERY {
+		return cmd, nil
+	}
+	converted := (session.Capability^capability)&protocol.CLIENT_QUERY_ATTRIBUTES != 0
+	if !converted && session.Capability&protocol.CLIENT_QUERY_ATTRIBUTES == 0 {
+		return cmd, nil
+	}
+
+	q, err := session.ParseQuery(cmd)
+	if err != nil {
+		// 交给 mysql 返回错误
+		return cmd, nil
+	}
+	session.Attributes = q.Attributes
+	if !converted && len(p.queryAttrs) == 0 {
+		return cmd, nil
+	}
+
+	for _, attr := range p.queryAttrs {
+		q.Attributes = q.Attributes.Set(attr)
+	}
+	return protocol.Packet{Payload: q.Encode(capability), SeqId: cmd.SeqId}, nil
+}
+
+// 读取 COM_STMT_EXECUTE 中的 query attributes, 加上代理的 attributes, params 是语句的参数个数
+func (p *Proxy) executeAttributes(session *protocol.Session, cmd protocol.Packet, params int, capability uint32, longData bool) (protocol.Packet, error) {
+	if longData {
+		return session.ConvertExecute(cmd, params, capability)
+	}
+	attrs, err := session.ExecuteAttributes(cmd, params)
+	if err != nil {
+		return cmd, err
+	}
+	session.Attributes = attrs
+	if len(p.queryAttrs) == 0 {
+		return session.ConvertExecute(cmd, params, capability)
+	}
+
+	for _, attr := range p.queryAttrs {
+		attrs = attrs.Set(attr)
+	}
+	return session.SetExecuteAttributes(cmd, params, attrs, capability)
+}
+
+func formatAttributes(attrs protocol.QueryAttributes) string {
+	items := make([]string, 0, len(attrs))
+	for _, attr := range attrs {
+		items = append(items, attr.Name+"="+attr.Text())
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lyuangg/umyproxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueryAttributes(t *testing.T) {
+	attrs, err := ParseQueryAttributes("app=web, region=us,app=api")
+	assert.Nil(t, err, "parse err")
+	assert.Equal(t, protocol.QueryAttributes{protocol.StringAttribute("app", "api"), protocol.StringAttribute("region", "us")}, attrs, "attributes err")
+
+	_, err = ParseQueryAttributes("app")
+	assert.NotNil(t, err, "invalid attribute parsed")
+}
+
+func TestInjectQueryAttributes(t *testing.T) {
+	p := NewProxy(NewPool(newOption(1)), "")
+	p.SetQueryAttributes(protocol.QueryAttributes{protocol.StringAttribute("app", "web")})
+	server := &MysqlTestConn{capability: protocol.CLIENT_PROTOCOL_41 | protocol.CLIENT_QUERY_ATTRIBUTES}
+
+	session := &protocol.Session{Capability: protocol.CLIENT_PROTOCOL_41 | protocol.CLIENT_QUERY_ATTRIBUTES}
+	q := protocol.Query{Attributes: protocol.QueryAttributes{protocol.StringAttribute("trace_id", "abc")}, Query: "SELECT 1"}
+	cmd, err := p.queryAttributes(session, server, protocol.Packet{Payload: q.Encode(session.Capability)}, false)
+	assert.Nil(t, err, "query attributes err")
+
+	sent, err := session.ParseQuery(cmd)
+	assert.Nil(t, err, "parse query err")
+	assert.Equal(t, "SELECT 1", sent.Query, "query err")
+	assert.Equal(t, protocol.QueryAttributes{protocol.StringAttribute("trace_id", "abc"), protocol.StringAttribute("app", "web")}, sent.Attributes, "injected attributes err")
+
+	// mysql 连接没有协商 CLIENT_QUERY_ATTRIBUTES 时原样发送
+	plain := &protocol.Session{Capability: protocol.CLIENT_PROTOCOL_41}
+	query := protocol.Packet{Payload: append([]byte{protocol.COM_QUERY}, "SELECT 1"...)}
+	cmd, err = p.queryAttributes(plain, &MysqlTestConn{}, query, false)
+	assert.Nil(t, err, "query attributes err")
+	assert.Equal(t, query, cmd, "plain query changed")
+}
+
+// 客户端没有协商 CLIENT_QUERY_ATTRIBUTES 时, mysql 连接仍然协商, 并转换为 attribute 格式
+func TestInjectQueryAttributesPlainClient(t *testing.T) {
+	p := newTestProxy()
+	p.SetQueryAttributes(protocol.QueryAttributes{protocol.StringAttribute("app", "web")})
+
+	resp := protocol.HandshakeResponse{Capability: protocol.CLIENT_BASIC_FLAGS, Charset: 45, User: "root"}
+	key := p.pool.Key(resp, nil)
+	assert.NotZero(t, key.Capability&protocol.CLIENT_QUERY_ATTRIBUTES, "backend capability not negotiated")
+
+	server := &MysqlTestConn{capability: key.Capability}
+	session := &protocol.Session{Capability: protocol.CLIENT_BASIC_FLAGS}
+	query := protocol.Packet{Payload: append([]byte{protocol.COM_QUERY}, "SELECT 1"...), SeqId: 0}
+	cmd, err := p.queryAttributes(session, server, query, false)
+	assert.Nil(t, err, "query attributes err")
+
+	sent, err := (&protocol.Session{Capability: key.Capability}).ParseQuery(cmd)
+	assert.Nil(t, err, "parse query err")
+	assert.Equal(t, "SELECT 1", sent.Query, "query err")
+	assert.Equal(t, protocol.QueryAttributes{protocol.StringAttribute("app", "web")}, sent.Attributes, "injected attributes err")
+
+	// 客户端预处理的语句执行时加上参数个数和代理的 attributes
+	session.AddStatement(1, 1)
+	execute := protocol.Packet{Payload: []byte{protocol.COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, protocol.MYSQL_TYPE_TINY, 0, 7}}
+	cmd, err = p.queryAttributes(session, server, execute, false)
+	assert.Nil(t, err, "query attributes err")
+	attrs, err := (&protocol.Session{Capability: key.Capability}).ExecuteAttributes(cmd, 1)
+	assert.Nil(t, err, "parse execute err")
+	assert.Equal(t, protocol.QueryAttributes{protocol.StringAttribute("app", "web")}, attrs, "execute attributes err")
+	assert.Equal(t, []byte{protocol.COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 1, protocol.MYSQL_TYPE_TINY, 0, 0}, cmd.Payload[:16], "execute params err")
+
+	// 有 COM_STMT_SEND_LONG_DATA 参数时只转换格式
+	cmd, err = p.queryAttributes(session, server, execute, true)
+	assert.Nil(t, err, "query attributes err")
+	assert.Equal(t, []byte{protocol.COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 1, protocol.MYSQL_TYPE_TINY, 0, 0, 7}, cmd.Payload, "execute not converted")
+}
+
+// 客户端的 attributes 记录在会话中
+func TestClientQueryAttributes(t *testing.T) {
+	p := newTestProxy()
+	capability := protocol.CLIENT_PROTOCOL_41 | protocol.CLIENT_QUERY_ATTRIBUTES
+	server := &MysqlTestConn{capability: capability}
+	session := &protocol.Session{Capability: capability}
+	trace := protocol.QueryAttributes{protocol.StringAttribute("trace_id", "abc")}
+
+	q := protocol.Query{Attributes: trace, Query: "SELECT 1"}
+	query := protocol.Packet{Payload: q.Encode(capability)}
+	cmd, err := p.queryAttributes(session, server, query, false)
+	assert.Nil(t, err, "query attributes err")
+	assert.Equal(t, query, cmd, "query changed")
+	assert.Equal(t, trace, session.Attributes, "query attributes err")
+
+	session.Attributes = nil
+	session.AddStatement(1, 0)
+	execute, err := session.SetExecuteAttributes(protocol.Packet{Payload: []byte{protocol.COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0}}, 0, trace, capability)
+	assert.Nil(t, err, "encode execute err")
+	cmd, err = p.queryAttributes(session, server, execute, false)
+	assert.Nil(t, err, "query attributes err")
+	assert.Equal(t, execute, cmd, "execute changed")
+	assert.Equal(t, trace, session.Attributes, "execute attributes err")
+}
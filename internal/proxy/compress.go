@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/lyuangg/umyproxy/protocol"
+)
+
+// 与 mysql 之间的压缩算法
+const (
+	CompressNone = "none"
+	CompressZlib = "zlib"
+	// 标准库没有 zstd, 暂不支持
+	CompressZstd = "zstd"
+)
+
+// 与 mysql 之间使用压缩协议, 只支持 zlib
+func NewCompressConnect(creater ConnCreater, algorithm string) (ConnCreater, error) {
+	switch algorithm {
+	case "", CompressNone:
+		return creater, nil
+	case CompressZlib:
+	case CompressZstd:
+		return nil, ErrZstdNotSupported
+	default:
+		return nil, fmt.Errorf("unknown compress algorithm: %s", algorithm)
+	}
+
+	return func(address string) (protocol.Connector, error) {
+		conn, err := creater(address)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := conn.(*protocol.Conn); ok {
+			c.SetCompress()
+		}
+		return conn, nil
+	}, nil
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyuangg/umyproxy/protocol"
+)
+
+type (
+	// 按用户名保存已知密码的用户凭据
+	credentials struct {
+		mu       sync.Mutex
+		lifetime time.Duration
+		users    map[string]credential
+	}
+
+	credential struct {
+		protocol.Credential
+		createdTime time.Time
+		// 配置的本地用户, 不会过期
+		static bool
+	}
+)
+
+func newCredentials(lifetime time.Duration) *credentials {
+	return &credentials{lifetime: lifetime, users: make(map[string]credential, 0)}
+}
+
+func (c *credentials) Get(user string) (protocol.Credential, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cred, ok := c.users[user]
+	if !ok {
+		return protocol.Credential{}, false
+	}
+
+	// 过期后重新由 mysql 服务端认证, 避免使用修改前的密码
+	if !cred.static && time.Now().Sub(cred.createdTime) >= c.lifetime {
+		delete(c.users, user)
+		return protocol.Credential{}, false
+	}
+	return cred.Credential, true
+}
+
+func (c *credentials) Set(user string, cred protocol.Credential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users[user] = credential{Credential: cred, createdTime: time.Now(), static: c.users[user].static}
+}
+
+// 删除登录时记录的凭据, 配置的本地用户不删除, 返回是否删除
+func (c *credentials) Delete(user string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cred, ok := c.users[user]
+	if !ok || cred.static {
+		return false
+	}
+	delete(c.users, user)
+	return true
+}
+
+// 设置本地用户列表
+func (c *credentials) Load(users map[string]protocol.Credential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for user, cred := range users {
+		c.users[user] = credential{Credential: cred, createdTime: time.Now(), static: true}
+	}
+}
+
+// 读取本地用户列表, 每行格式为 user:password,
+// password 为 * 加 40 位十六进制时表示 mysql_native_password 的 hash (mysql.user 中的 authentication_string)
+func LoadUsers(file string) (map[string]protocol.Credential, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read users file err: %w", err)
+	}
+
+	users := make(map[string]protocol.Credential, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("users file line %d: missing user", i+1)
+		}
+		user, password := line[:idx], line[idx+1:]
+
+		cred := protocol.Credential{}
+		if len(password) == 41 && password[0] == '*' {
+			stage2, err := hex.DecodeString(password[1:])
+			if err != nil {
+				return nil, fmt.Errorf("users file line %d: %w", i+1, err)
+			}
+			cred.NativeStage2 = stage2
+		} else {
+			cred.SetPassword([]byte(password))
+		}
+		users[user] = cred
+	}
+	return users, nil
+}
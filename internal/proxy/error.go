@@ -8,4 +8,10 @@ var (
     ErrPoolClosed = errors.New("connection closed")
     ErrPoolFull = errors.New("pool full")
     ErrWaitConnTimeout = errors.New("wait mysql connection timeout")
+    ErrConnUnknown = errors.New("connection not from pool")
+    ErrSocketInUse = errors.New("socket file is used by another proxy")
+    ErrNotSocket = errors.New("file is not a socket")
+    ErrResetSession = errors.New("reset session err")
+    ErrResetNotSupported = errors.New("reset session not supported")
+    ErrZstdNotSupported = errors.New("zstd compression not supported")
 )
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+type (
+	// unix socket 客户端进程的身份 (SO_PEERCRED)
+	PeerCred struct {
+		Pid int32
+		Uid uint32
+		Gid uint32
+	}
+
+	// 允许访问的客户端, 满足任意一条规则即可, 为空时不限制
+	PeerAllow struct {
+		Uids []uint32
+		Gids []uint32
+		Pids []int32
+	}
+)
+
+func (c PeerCred) String() string {
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", c.Pid, c.Uid, c.Gid)
+}
+
+// 读取 unix socket 客户端的身份, 其他连接返回 nil
+func GetPeerCred(conn net.Conn) (*PeerCred, error) {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil
+	}
+	return getPeerCred(uconn)
+}
+
+// 解析允许规则, 逗号分隔, 例如 uid:33,gid:www-data,user:alice,pid:1234
+func ParsePeerAllow(rules string) (PeerAllow, error) {
+	allow := PeerAllow{}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		idx := strings.Index(rule, ":")
+		if idx <= 0 {
+			return allow, fmt.Errorf("invalid allow rule: %s", rule)
+		}
+		kind, value := rule[:idx], rule[idx+1:]
+
+		switch kind {
+		case "uid", "user":
+			uid, err := lookupUid(value, kind == "user")
+			if err != nil {
+				return allow, fmt.Errorf("invalid allow rule %s: %w", rule, err)
+			}
+			allow.Uids = append(allow.Uids, uid)
+		case "gid", "group":
+			gid, err := lookupGid(value, kind == "group")
+			if err != nil {
+				return allow, fmt.Errorf("invalid allow rule %s: %w", rule, err)
+			}
+			allow.Gids = append(allow.Gids, gid)
+		case "pid":
+			pid, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return allow, fmt.Errorf("invalid allow rule %s: %w", rule, err)
+			}
+			allow.Pids = append(allow.Pids, int32(pid))
+		default:
+			return allow, fmt.Errorf("invalid allow rule: %s", rule)
+		}
+	}
+	return allow, nil
+}
+
+// 数字 uid 或系统用户名
+func lookupUid(value string, byName bool) (uint32, error) {
+	return lookupId(value, byName, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+// 数字 gid 或系统用户组名
+func lookupGid(value string, byName bool) (uint32, error) {
+	return lookupId(value, byName, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+// 数字 id 直接使用, 名称时 (或 byName 为 true) 查找系统用户或用户组
+func lookupId(value string, byName bool, lookup func(string) (string, error)) (uint32, error) {
+	if !byName {
+		if id, err := strconv.ParseUint(value, 10, 32); err == nil {
+			return uint32(id), nil
+		}
+	}
+	idStr, err := lookup(value)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	return uint32(id), err
+}
+
+func (a PeerAllow) Empty() bool {
+	return len(a.Uids) == 0 && len(a.Gids) == 0 && len(a.Pids) == 0
+}
+
+// 只比较进程的主用户组
+func (a PeerAllow) Allowed(cred PeerCred) bool {
+	if a.Empty() {
+		return true
+	}
+	for _, uid := range a.Uids {
+		if cred.Uid == uid {
+			return true
+		}
+	}
+	for _, gid := range a.Gids {
+		if cred.Gid == gid {
+			return true
+		}
+	}
+	for _, pid := range a.Pids {
+		if cred.Pid == pid {
+			return true
+		}
+	}
+	return false
+}
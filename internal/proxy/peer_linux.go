@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("get peer cred err: %w", err)
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get peer cred err: %w", err)
+	}
+	return &PeerCred{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
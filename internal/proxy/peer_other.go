@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errors.New("peer cred not supported on this platform")
+}
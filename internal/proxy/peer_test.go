@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/lyuangg/umyproxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerAllow(t *testing.T) {
+	allow, err := ParsePeerAllow("uid:33, gid:1000,pid:42")
+	assert.Nil(t, err, "parse err")
+	assert.Equal(t, []uint32{33}, allow.Uids, "uids err")
+	assert.Equal(t, []uint32{1000}, allow.Gids, "gids err")
+	assert.Equal(t, []int32{42}, allow.Pids, "pids err")
+
+	assert.True(t, allow.Allowed(PeerCred{Pid: 1, Uid: 33, Gid: 1}), "uid not allowed")
+	assert.True(t, allow.Allowed(PeerCred{Pid: 1, Uid: 1, Gid: 1000}), "gid not allowed")
+	assert.True(t, allow.Allowed(PeerCred{Pid: 42, Uid: 1, Gid: 1}), "pid not allowed")
+	assert.False(t, allow.Allowed(PeerCred{Pid: 1, Uid: 1, Gid: 1}), "peer allowed")
+	assert.True(t, PeerAllow{}.Allowed(PeerCred{}), "empty rules not allowed")
+
+	_, err = ParsePeerAllow("uid")
+	assert.NotNil(t, err, "invalid rule parsed")
+	_, err = ParsePeerAllow("host:localhost")
+	assert.NotNil(t, err, "unknown rule parsed")
+}
+
+func unixPair(t *testing.T) (net.Conn, net.Conn) {
+	file := filepath.Join(t.TempDir(), "test.socket")
+	l, err := net.Listen("unix", file)
+	assert.Nil(t, err, "listen err")
+	defer l.Close()
+
+	c1, err := net.Dial("unix", file)
+	assert.Nil(t, err, "dial err")
+	c2, err := l.Accept()
+	assert.Nil(t, err, "accept err")
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+func TestGetPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer cred only supported on linux")
+	}
+	_, c2 := unixPair(t)
+	peer, err := GetPeerCred(c2)
+	assert.Nil(t, err, "get peer cred err")
+	assert.Equal(t, uint32(os.Getuid()), peer.Uid, "uid err")
+	assert.Equal(t, int32(os.Getpid()), peer.Pid, "pid err")
+}
+
+func TestPeerNotAllowed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer cred only supported on linux")
+	}
+	p := newTestProxy()
+	p.SetPeerAllow(PeerAllow{Uids: []uint32{uint32(os.Getuid()) + 1}})
+
+	c1, c2 := unixPair(t)
+	go p.HandleConn(c2)
+
+	packet, err := protocol.NewConn(c1).ReadPacket()
+	assert.Nil(t, err, "read err")
+	assert.True(t, protocol.IsErrPacket(packet), "not err packet")
+	assert.Equal(t, protocol.ER_HOST_NOT_PRIVILEGED, protocol.ParseErrPacket(packet).Code, "err code err")
+	assert.Equal(t, 0, p.pool.OpenSize(), "mysql conn opened")
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lyuangg/umyproxy/protocol"
+)
+
+// 连接池模式
+const (
+	// 客户端断开前一直使用同一个 mysql 连接
+	PoolModeSession = "session"
+	// 事务结束后把 mysql 连接放回连接池, 修改了会话状态的客户端固定使用当前连接
+	PoolModeTransaction = "transaction"
+)
+
+// transaction 模式下客户端带有这个 query attribute 的命令固定 mysql 连接
+const PinAttribute = "umyproxy.pin"
+
+var (
+	// 会修改会话状态的语句
+	pinStatementRegexp = regexp.MustCompile(`(?is)^\s*(create\s+temporary\s|lock\s+tables?\s|set\s|prepare\s|use\s|xa\s|handler\s|flush\s+tables?\b.*\bwith\s+read\s+lock)`)
+	// 切换当前数据库的语句
+	useStatementRegexp = regexp.MustCompile(`(?is)^\s*use\s`)
+	// 用户锁、用户变量和之后的 FOUND_ROWS()
+	pinExprRegexp = regexp.MustCompile(`(?i)\bget_lock\s*\(|\bsql_calc_found_rows\b|(^|[^@\w])@[\w$.'"` + "`" + `]`)
+)
+
+// 返回命令需要固定 mysql 连接的原因, 不需要时返回空字符串
+func pinReason(session *protocol.Session, cmd protocol.Packet) string {
+	if len(cmd.Payload) == 0 {
+		return ""
+	}
+	switch cmd.Payload[0] {
+	case protocol.COM_QUERY:
+		// CLIENT_QUERY_ATTRIBUTES 时 sql 在 attributes 之后
+		q, err := session.ParseQuery(cmd)
+		if err != nil {
+			return ""
+		}
+		return pinQueryReason(q.Query)
+	case protocol.COM_INIT_DB:
+		return "init db"
+	case protocol.COM_CHANGE_USER:
+		return "change user"
+	case protocol.COM_SET_OPTION:
+		return "set option"
+	}
+	return ""
+}
+
+// 命令是否会切换当前数据库, 连接放回连接池时需要恢复
+// 没有协商 CLIENT_SESSION_TRACK 的客户端只能从命令判断
+func changesDatabase(session *protocol.Session, cmd protocol.Packet) bool {
+	switch cmd.Command() {
+	case protocol.COM_INIT_DB, protocol.COM_CHANGE_USER:
+		return true
+	case protocol.COM_QUERY:
+		q, err := session.ParseQuery(cmd)
+		if err != nil {
+			return false
+		}
+		for _, stmt := range strings.Split(stripQuery(q.Query), ";") {
+			if useStatementRegexp.MatchString(stmt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func pinQueryReason(query string) string {
+	for _, stmt := range strings.Split(stripQuery(query), ";") {
+		if m := pinStatementRegexp.FindStringSubmatch(stmt); m != nil {
+			return strings.ToLower(strings.Join(strings.Fields(m[1]), " "))
+		}
+		if m := pinExprRegexp.FindString(stmt); m != "" {
+			return strings.ToLower(strings.TrimSpace(m))
+		}
+	}
+	return ""
+}
+
+// 去掉注释和字符串内容, 避免误判其中的关键字
+func stripQuery(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			b.WriteByte(c)
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' {
+					i++
+				} else if query[i] == c {
+					if i+1 < len(query) && query[i+1] == c {
+						i++
+						continue
+					}
+					b.WriteByte(c)
+					break
+				}
+			}
+		case strings.HasPrefix(query[i:], "/*!"):
+			// 可执行的注释, 保留其中的语句
+			b.WriteByte(' ')
+			for i += 3; i < len(query) && query[i] >= '0' && query[i] <= '9'; i++ {
+			}
+			i--
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return b.String()
+			}
+			b.WriteByte(' ')
+			i += end + 3
+		case c == '#' || (c == '-' && strings.HasPrefix(query[i:], "-- ")):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return b.String()
+			}
+			b.WriteByte(' ')
+			i += end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
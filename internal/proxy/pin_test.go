@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lyuangg/umyproxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinReason(t *testing.T) {
+	testCase := []struct {
+		query  string
+		reason string
+	}{
+		{"SELECT 1", ""},
+		{"select * from users where email = 'a@example.com'", ""},
+		{"select @@version", ""},
+		{"BEGIN", ""},
+		{"CREATE TEMPORARY TABLE t (id int)", "create temporary"},
+		{"  /* comment */ lock tables t write", "lock tables"},
+		{"SET NAMES utf8mb4", "set"},
+		{"set @a = 1", "set"},
+		{"select @a := 1", "@a"},
+		{"SELECT GET_LOCK('a', 10)", "get_lock("},
+		{"select 1; use test", "use"},
+		{"PREPARE stmt FROM 'select 1'", "prepare"},
+		{"/*!40101 SET character_set_client = utf8 */", "set"},
+		{"select '; set @a = 1'", ""},
+		{"select 1 -- ; set @a = 1", ""},
+		{"SELECT SQL_CALC_FOUND_ROWS * FROM t", "sql_calc_found_rows"},
+		{"FLUSH TABLES WITH READ LOCK", "flush tables with read lock"},
+	}
+
+	session := &protocol.Session{}
+	attrSession := &protocol.Session{Capability: protocol.CLIENT_QUERY_ATTRIBUTES}
+	for _, c := range testCase {
+		cmd := protocol.Packet{Payload: append([]byte{protocol.COM_QUERY}, c.query...)}
+		assert.Equal(t, c.reason, pinReason(session, cmd), c.query)
+
+		// 带有 query attributes 的 COM_QUERY
+		q := protocol.Query{Attributes: protocol.QueryAttributes{protocol.StringAttribute("trace_id", "abc")}, Query: c.query}
+		cmd = protocol.Packet{Payload: q.Encode(attrSession.Capability)}
+		assert.Equal(t, c.reason, pinReason(attrSession, cmd), c.query)
+	}
+
+	// 预处理语句使用虚拟 id, 不固定连接
+	assert.Empty(t, pinReason(session, protocol.Packet{Payload: []byte{protocol.COM_STMT_PREPARE}}), "prepare pinned")
+	assert.NotEmpty(t, pinReason(session, protocol.Packet{Payload: []byte{protocol.COM_INIT_DB}}), "init db not pinned")
+	assert.Empty(t, pinReason(session, protocol.Packet{Payload: []byte{protocol.COM_PING}}), "ping pinned")
+}
+
+func TestChangesDatabase(t *testing.T) {
+	session := &protocol.Session{}
+	for query, changed := range map[string]bool{
+		"SELECT 1":                false,
+		"USE test":                true,
+		"set @a = 1; use test":    true,
+		"select 'use test'":       false,
+		"select * from used_keys": false,
+	} {
+		cmd := protocol.Packet{Payload: append([]byte{protocol.COM_QUERY}, query...)}
+		assert.Equal(t, changed, changesDatabase(session, cmd), query)
+	}
+	assert.True(t, changesDatabase(session, protocol.Packet{Payload: append([]byte{protocol.COM_INIT_DB}, "test"...)}), "init db")
+	assert.False(t, changesDatabase(session, protocol.Packet{Payload: []byte{protocol.COM_PING}}), "ping")
+}
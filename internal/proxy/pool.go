@@ -4,11 +4,30 @@ import (
 	"errors"
 	"fmt"
 	"github.com/lyuangg/umyproxy/protocol"
+	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+const (
+	// 未认证的连接需要在 mysql connect_timeout 之前使用
+	handshakeTimeout = 5 * time.Second
+
+	// 预先创建的连接使用的 capability, 与 mysqlnd 默认协商的一致
+	prefillCapability = protocol.CLIENT_MULTI_RESULTS | protocol.CLIENT_PS_MULTI_RESULTS
+)
+
+// 连接放回池中前重置会话的方式
+const (
+	// 不重置
+	ResetNone = "none"
+	// COM_RESET_CONNECTION, 服务端不支持或不能清除当前数据库时代理管理账号的连接使用 COM_CHANGE_USER
+	ResetConnection = "reset"
+	// COM_CHANGE_USER, 需要代理管理 mysql 账号
+	ResetChangeUser = "change_user"
+)
+
 type (
 	PoolOption struct {
 		Host        string
@@ -16,81 +35,202 @@ type (
 		MaxLifetime time.Duration
 		PoolMaxSize int
 		WaitTimeout time.Duration
+
+		// 代理管理的 mysql 账号, 为空时透传客户端的认证
+		User     string
+		Password []byte
+
+		// 启动时预先创建的连接数, 以及这些连接使用的数据库和字符集
+		Prefill  int
+		Database string
+		Charset  uint8
+
+		// 按 unix socket 客户端的 uid 分区
+		PeerPartition bool
+
+		// 放回池中前重置会话的方式, 为空时不重置
+		Reset string
+
+		// 连接池模式, 为空时使用 session 模式
+		Mode string
+
+		// transaction 模式下每个连接缓存的预处理语句数, 为 0 时使用 DefaultStmtCacheSize
+		StmtCacheSize int
+
+		// mysql 连接总是协商 CLIENT_QUERY_ATTRIBUTES, 与客户端是否协商无关
+		QueryAttributes bool
+	}
+
+	// 连接池分区 key, 只复用相同身份认证的连接
+	ConnKey struct {
+		User       string
+		Database   string
+		Charset    uint8
+		Capability uint32
+		// unix socket 客户端的身份
+		Peer string
 	}
 
 	Pool struct {
 		option       PoolOption
 		mu           sync.Mutex
-		freeConn     []protocol.Connector
+		freeConn     map[ConnKey][]protocol.Connector
+		connKeys     map[protocol.Connector]ConnKey
+		stmtCaches   map[protocol.Connector]*stmtCache
 		openSize     int
-		connRequests map[uint64]chan protocol.Connector
+		connRequests map[uint64]connRequest
 		nextRequest  uint64
 		closed       bool
 		createConn   ConnCreater
+		handshake    *protocol.Handshake
+		// 服务端不支持 COM_RESET_CONNECTION 且不能使用 COM_CHANGE_USER 时不再重置
+		resetDisabled bool
+	}
+
+	// 等待连接的请求, 收到 nil 表示已为请求预留了一个新连接的名额
+	connRequest struct {
+		key ConnKey
+		ch  chan protocol.Connector
 	}
 
 	ConnCreater func(string) (protocol.Connector, error)
 )
 
 func NewPool(option PoolOption) *Pool {
-	freeConn := make([]protocol.Connector, 0)
-	connRequest := make(map[uint64]chan protocol.Connector, 0)
+	freeConn := make(map[ConnKey][]protocol.Connector, 0)
+	connKeys := make(map[protocol.Connector]ConnKey, 0)
+	connRequest := make(map[uint64]connRequest, 0)
 	var createConn ConnCreater
 	createConn = NewConnect
-	return &Pool{option: option, freeConn: freeConn, connRequests: connRequest, createConn: createConn}
+	stmtCaches := make(map[protocol.Connector]*stmtCache, 0)
+	return &Pool{option: option, freeConn: freeConn, connKeys: connKeys, stmtCaches: stmtCaches, connRequests: connRequest, createConn: createConn}
+}
+
+// 代理管理 mysql 账号
+func (o PoolOption) Managed() bool {
+	return o.User != ""
+}
+
+// 客户端对应的连接池分区, 客户端与代理之间的 SSL 不影响 mysql 连接
+func (p *Pool) Key(resp protocol.HandshakeResponse, peer *PeerCred) ConnKey {
+	key := ConnKey{User: resp.User, Database: resp.Database, Charset: resp.Charset, Capability: resp.Capability &^ protocol.CLIENT_SSL}
+	if p.option.QueryAttributes {
+		key.Capability |= protocol.CLIENT_QUERY_ATTRIBUTES
+	}
+	if p.option.Managed() {
+		key.User = ""
+		key.Capability &= protocol.CLIENT_SESSION_FLAGS
+	}
+	if p.option.PeerPartition && peer != nil {
+		key.Peer = fmt.Sprintf("uid=%d", peer.Uid)
+	}
+	return key
 }
 
 func (p *Pool) SetCreater(creater ConnCreater) {
 	p.createConn = creater
 }
 
-func (p *Pool) Get() (protocol.Connector, error) {
+// 返回 mysql 服务端的握手包, 第一次调用时会创建一个未认证的连接放入池中
+func (p *Pool) Handshake() (protocol.Handshake, error) {
 	p.mu.Lock()
-	if p.closed {
+	if p.handshake != nil {
+		hs := *p.handshake
 		p.mu.Unlock()
-		return nil, errors.New("pool closed")
+		return hs, nil
 	}
+	p.mu.Unlock()
 
-	// 空闲连接
-	freeNum := len(p.freeConn)
-	if freeNum > 0 {
-		for i, conn := range p.freeConn {
+	conn, err := p.Get(ConnKey{})
+	if err != nil {
+		return protocol.Handshake{}, err
+	}
+	hs, err := conn.Handshake()
+	if err != nil {
+		conn.Close()
+		p.put(conn)
+		return hs, err
+	}
+	p.setHandshake(hs)
 
-			// 判断 conn 过期
-			if !conn.Expired(p.option.MaxLifetime) && !conn.Closed() {
+	p.put(conn)
+	return hs, nil
+}
 
-				// 删除
-				copy(p.freeConn, p.freeConn[i+1:])
-				p.freeConn = p.freeConn[:freeNum-i-1]
+func (p *Pool) setHandshake(hs protocol.Handshake) {
+	p.mu.Lock()
+	if p.handshake == nil {
+		p.handshake = &hs
+	}
+	p.mu.Unlock()
+}
 
-				conn.RefreshUseTime()
+// 代理管理 mysql 账号时预先创建连接
+func (p *Pool) Prefill() error {
+	if !p.option.Managed() {
+		return nil
+	}
 
-				p.mu.Unlock()
-				return conn, nil
-			}
+	key := ConnKey{Database: p.option.Database, Charset: p.option.Charset, Capability: prefillCapability}
+	if p.option.QueryAttributes {
+		key.Capability |= protocol.CLIENT_QUERY_ATTRIBUTES
+	}
+	conns := make([]protocol.Connector, 0, p.option.Prefill)
+	var err error
+	for i := 0; i < p.option.Prefill && i < p.option.PoolMaxSize; i++ {
+		conn, getErr := p.Get(key)
+		if getErr != nil {
+			err = getErr
+			break
+		}
+		conns = append(conns, conn)
+	}
 
-			conn.Close()
-			p.openSize--
+	for _, conn := range conns {
+		if hs, hsErr := conn.Handshake(); hsErr == nil {
+			p.setHandshake(hs)
 		}
+		p.put(conn)
+	}
+	return err
+}
+
+func (p *Pool) Get(key ConnKey) (protocol.Connector, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("pool closed")
+	}
 
-		// clean all
-		p.freeConn = nil
+	// 空闲连接
+	if conn := p.popFree(key, p.option.MaxLifetime); conn != nil {
+		p.mu.Unlock()
+		return conn, nil
 	}
 
-	// 创建新连接
-	if p.openSize < p.option.PoolMaxSize {
-		conn, err := p.createConn(fmt.Sprintf("%s:%d", p.option.Host, p.option.Port))
-		if err != nil {
+	// 未认证的连接
+	if key != (ConnKey{}) {
+		if conn := p.popFree(ConnKey{}, handshakeTimeout); conn != nil {
+			p.connKeys[conn] = key
 			p.mu.Unlock()
-			return nil, fmt.Errorf("new connect err: %w", err)
+			return p.open(key, conn)
 		}
+	}
+
+	// 连接数已满时关闭其他分区的空闲连接
+	if p.openSize >= p.option.PoolMaxSize {
+		p.evictFree()
+	}
+
+	// 创建新连接
+	if p.openSize < p.option.PoolMaxSize {
 		p.openSize++
 		p.mu.Unlock()
-		return conn, nil
+		return p.open(key, nil)
 	}
 
 	// 等待队列
-	req := make(chan protocol.Connector, 1)
+	req := connRequest{key: key, ch: make(chan protocol.Connector, 1)}
 	reqKey := p.nextRequest + 1
 	p.nextRequest = reqKey
 	p.connRequests[reqKey] = req
@@ -104,72 +244,275 @@ func (p *Pool) Get() (protocol.Connector, error) {
 		// put
 		select {
 		default:
-		case conn, ok := <-req:
-			if ok && !conn.Closed() && !conn.Expired(p.option.MaxLifetime) {
-				p.Put(conn)
+		case conn, ok := <-req.ch:
+			if ok && conn == nil {
+				p.mu.Lock()
+				p.openSize--
+				p.mu.Unlock()
+			} else if ok {
+				p.put(conn)
 			}
 		}
 
 		return nil, ErrWaitConnTimeout
-	case conn, ok := <-req:
+	case conn, ok := <-req.ch:
 		if !ok {
 			return nil, ErrWaitConnTimeout
 		}
-		return conn, nil
+		if conn != nil {
+			return conn, nil
+		}
+		return p.open(key, nil)
 	}
 }
 
+// 使用已占用的名额创建新连接, 代理管理 mysql 账号时完成登录
+func (p *Pool) open(key ConnKey, conn protocol.Connector) (protocol.Connector, error) {
+	if conn == nil {
+		var err error
+		conn, err = p.createConn(fmt.Sprintf("%s:%d", p.option.Host, p.option.Port))
+		p.mu.Lock()
+		if err != nil {
+			p.openSize--
+			p.mu.Unlock()
+			return nil, fmt.Errorf("new connect err: %w", err)
+		}
+		p.connKeys[conn] = key
+		p.mu.Unlock()
+	}
+
+	if p.option.Managed() && key != (ConnKey{}) {
+		if err := conn.Connect(p.account(key)); err != nil {
+			p.mu.Lock()
+			p.closeConn(conn)
+			p.mu.Unlock()
+			return nil, fmt.Errorf("mysql login err: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (p *Pool) account(key ConnKey) protocol.Account {
+	return protocol.Account{
+		User:       p.option.User,
+		Password:   p.option.Password,
+		Database:   key.Database,
+		Charset:    key.Charset,
+		Capability: key.Capability,
+	}
+}
+
+// 重置会话状态, 服务端同时会释放连接上的预处理语句
+// 客户端切换过当前数据库时 (databaseChanged) 恢复连接的数据库
+func (p *Pool) reset(conn protocol.Connector, key ConnKey, databaseChanged bool) error {
+	switch p.option.Reset {
+	case "", ResetNone:
+		return nil
+	case ResetConnection:
+		p.mu.Lock()
+		disabled := p.resetDisabled
+		p.mu.Unlock()
+		if disabled {
+			return nil
+		}
+		// COM_INIT_DB 不能清除当前数据库, 代理管理账号时重新登录
+		if databaseChanged && key.Database == "" && p.option.Managed() {
+			return conn.ChangeUser(p.account(key))
+		}
+
+		database := ""
+		if databaseChanged {
+			database = key.Database
+		}
+		err := conn.Reset(database)
+		var sqlErr *protocol.SQLError
+		if errors.As(err, &sqlErr) && sqlErr.Code == protocol.ER_UNKNOWN_COM_ERROR {
+			if p.option.Managed() {
+				return conn.ChangeUser(p.account(key))
+			}
+			// 透传认证时没有密码不能使用 COM_CHANGE_USER, 关闭这个连接, 之后的连接不再重置
+			p.mu.Lock()
+			p.resetDisabled = true
+			p.mu.Unlock()
+			log.Println("warning: mysql does not support COM_RESET_CONNECTION, session reset disabled")
+		}
+		if err != nil || !databaseChanged || key.Database != "" {
+			return err
+		}
+
+		// 透传认证时不能清除当前数据库, 连接放到当前数据库的分区
+		current, err := protocol.CurrentDatabase(conn)
+		if err != nil || current == "" {
+			return err
+		}
+		key.Database = current
+		p.mu.Lock()
+		if _, ok := p.connKeys[conn]; ok {
+			p.connKeys[conn] = key
+		}
+		p.mu.Unlock()
+		return nil
+	case ResetChangeUser:
+		if !p.option.Managed() {
+			return ErrResetNotSupported
+		}
+		return conn.ChangeUser(p.account(key))
+	}
+	return fmt.Errorf("unknown reset mode: %s", p.option.Reset)
+}
+
+// 取出一个可用的空闲连接, 过期的连接会被关闭
+func (p *Pool) popFree(key ConnKey, lifetime time.Duration) protocol.Connector {
+	conns := p.freeConn[key]
+	for i, conn := range conns {
+
+		// 判断 conn 过期
+		if !conn.Expired(lifetime) && !conn.Closed() {
+
+			// 删除
+			p.freeConn[key] = conns[i+1:]
+
+			conn.RefreshUseTime()
+			return conn
+		}
+
+		p.closeConn(conn)
+	}
+
+	// clean all
+	delete(p.freeConn, key)
+	return nil
+}
+
+// 关闭一个其他分区的空闲连接
+func (p *Pool) evictFree() {
+	for key, conns := range p.freeConn {
+		if len(conns) == 0 {
+			continue
+		}
+		p.freeConn[key] = conns[1:]
+		p.closeConn(conns[0])
+		return
+	}
+}
+
+func (p *Pool) closeConn(conn protocol.Connector) {
+	conn.Close()
+	delete(p.connKeys, conn)
+	delete(p.stmtCaches, conn)
+	p.openSize--
+}
+
+// 连接上缓存的预处理语句
+func (p *Pool) statements(conn protocol.Connector) *stmtCache {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cache, ok := p.stmtCaches[conn]
+	if !ok {
+		cache = newStmtCache(p.option.StmtCacheSize)
+		p.stmtCaches[conn] = cache
+	}
+	return cache
+}
+
+// 放回客户端使用过的连接, 重置会话失败时关闭连接
 func (p *Pool) Put(conn protocol.Connector) error {
+	return p.PutSession(conn, false)
+}
+
+// 放回客户端使用过的连接, 客户端切换过当前数据库时 (databaseChanged) 重置后恢复连接的数据库
+func (p *Pool) PutSession(conn protocol.Connector, databaseChanged bool) error {
+	p.mu.Lock()
+	key, ok := p.connKeys[conn]
+	p.mu.Unlock()
+
+	var resetErr error
+	if ok && key != (ConnKey{}) && !conn.Closed() {
+		resetErr = p.reset(conn, key, databaseChanged)
+		if resetErr != nil {
+			conn.Close()
+		}
+		if p.option.Reset != "" && p.option.Reset != ResetNone {
+			p.mu.Lock()
+			delete(p.stmtCaches, conn)
+			p.mu.Unlock()
+		}
+	}
+
+	if err := p.put(conn); err != nil && resetErr == nil {
+		return err
+	}
+	if resetErr != nil {
+		return fmt.Errorf("%w: %v", ErrResetSession, resetErr)
+	}
+	return nil
+}
+
+func (p *Pool) put(conn protocol.Connector) error {
 	p.mu.Lock()
 	if p.closed {
-		conn.Close()
-		p.openSize--
+		p.closeConn(conn)
 		p.mu.Unlock()
 		return ErrPoolClosed
 	}
 
+	key, ok := p.connKeys[conn]
+	if !ok {
+		p.mu.Unlock()
+		return ErrConnUnknown
+	}
+
 	if conn.Expired(p.option.MaxLifetime) || conn.Closed() {
-		conn.Close()
-		p.openSize--
+		p.closeConn(conn)
 		p.mu.Unlock()
 		return ErrConnExpired
 	}
 	conn.RefreshUseTime()
 
 	// 请求队列
-	if len(p.connRequests) > 0 {
-		for reqKey, ch := range p.connRequests {
-			ch <- conn
-			delete(p.connRequests, reqKey)
-			close(ch)
+	for reqKey, req := range p.connRequests {
+		if req.key == key {
+			p.sendRequest(reqKey, req, conn)
 			p.mu.Unlock()
 			return nil
 		}
 	}
 
-	// 放入freeConn
-	freeNum := len(p.freeConn)
-	if freeNum >= p.option.PoolMaxSize {
-		// 删掉一个
-		copy(p.freeConn, p.freeConn[1:])
-		p.freeConn = p.freeConn[:len(p.freeConn)-1]
+	// 其他分区的请求, 关闭连接并把名额让给请求
+	for reqKey, req := range p.connRequests {
+		conn.Close()
+		delete(p.connKeys, conn)
+		delete(p.stmtCaches, conn)
+		p.sendRequest(reqKey, req, nil)
+		p.mu.Unlock()
+		return nil
 	}
-	p.freeConn = append(p.freeConn, conn)
+
+	// 放入freeConn
+	p.freeConn[key] = append(p.freeConn[key], conn)
 	p.mu.Unlock()
 
 	return nil
 }
 
+func (p *Pool) sendRequest(reqKey uint64, req connRequest, conn protocol.Connector) {
+	req.ch <- conn
+	delete(p.connRequests, reqKey)
+	close(req.ch)
+}
+
 func (p *Pool) Close() {
 	p.mu.Lock()
 	p.closed = true
-	for _, conn := range p.freeConn {
-		p.openSize--
-		conn.Close()
+	for _, conns := range p.freeConn {
+		for _, conn := range conns {
+			p.closeConn(conn)
+		}
 	}
-	p.freeConn = nil
-	for _, reqCh := range p.connRequests {
-		close(reqCh)
+	p.freeConn = make(map[ConnKey][]protocol.Connector, 0)
+	for _, req := range p.connRequests {
+		close(req.ch)
 	}
 	p.mu.Unlock()
 }
@@ -10,22 +10,39 @@ import (
 
 type (
     // for testing. implements interface protocol.Connector
-    MysqlTestConn struct {}
+    MysqlTestConn struct {
+        id int
+        resets int
+        resetErr error
+        // 最后一次重置时切换回的数据库
+        resetDatabase string
+        changeUsers int
+        // 登录 mysql 时协商的 capability
+        capability uint32
+        closed bool
+        // 已登录 mysql 和认证客户端时返回的错误
+        authenticated bool
+        authErr error
+        auths int
+        // ReadPacket 依次返回的包和 WritePacket 写入的包
+        reads []protocol.Packet
+        writes []protocol.Packet
+    }
 )
 
 func TestGet(t *testing.T) {
     p := NewPool(newOption(2))
     p.SetCreater(newTestCreater)
 
-    conn, err := p.Get()
+    conn, err := p.Get(ConnKey{User: "test"})
     assert.Nil(t, err, "pool: conn err")
     assert.NotNil(t, conn, "pool: conn is nil")
 
-    conn2, err2 := p.Get()
+    conn2, err2 := p.Get(ConnKey{User: "test"})
     assert.Nil(t, err2, "pool: conn2 err")
     assert.NotNil(t, conn2, "pool: conn2 is nil")
 
-    conn3, err3 := p.Get()
+    conn3, err3 := p.Get(ConnKey{User: "test"})
     assert.ErrorIs(t, err3, ErrWaitConnTimeout)
     assert.Nil(t, conn3, "pool: conn3 is not nil")
 }
@@ -34,13 +51,13 @@ func TestPutConn(t *testing.T) {
     p := NewPool(newOption(1))
     p.SetCreater(newTestCreater)
 
-    conn, err := p.Get()
+    conn, err := p.Get(ConnKey{User: "test"})
     assert.Nil(t, err, "pool: conn err")
     assert.NotNil(t, conn, "pool: conn is nil")
 
     p.Put(conn)
 
-    conn2, err2 := p.Get()
+    conn2, err2 := p.Get(ConnKey{User: "test"})
     assert.Nil(t, err2, "pool: conn2 err")
     assert.NotNil(t, conn2, "pool: conn2 is nil")
     assert.Equal(t, conn, conn2, "pool: conn not equal conn2")
@@ -51,11 +68,172 @@ func TestPutConn(t *testing.T) {
         p.Put(conn2)
     }()
 
-    conn3, err3 := p.Get()
+    conn3, err3 := p.Get(ConnKey{User: "test"})
     assert.Nil(t, err3, "pool: conn3 err")
     assert.Equal(t, conn2, conn3, "pool: conn2 not equal conn3")
 }
 
+func TestPartition(t *testing.T) {
+    p := NewPool(newOption(2))
+    p.SetCreater(newTestCreater)
+
+    conn, err := p.Get(ConnKey{User: "app_rw"})
+    assert.Nil(t, err, "pool: conn err")
+    p.Put(conn)
+
+    // 不同分区不能复用
+    conn2, err2 := p.Get(ConnKey{User: "report_ro"})
+    assert.Nil(t, err2, "pool: conn2 err")
+    assert.NotEqual(t, conn, conn2, "pool: conn reused by other key")
+    p.Put(conn2)
+
+    conn3, err3 := p.Get(ConnKey{User: "app_rw"})
+    assert.Nil(t, err3, "pool: conn3 err")
+    assert.Equal(t, conn, conn3, "pool: conn not equal conn3")
+    p.Put(conn3)
+
+    // 连接数已满时关闭其他分区的空闲连接
+    conn4, err4 := p.Get(ConnKey{User: "other"})
+    assert.Nil(t, err4, "pool: conn4 err")
+    assert.NotEqual(t, conn, conn4, "pool: conn reused by other key")
+    assert.NotEqual(t, conn2, conn4, "pool: conn2 reused by other key")
+    assert.Equal(t, 2, p.OpenSize(), "pool: open size err")
+}
+
+func TestHandshakeConn(t *testing.T) {
+    p := NewPool(newOption(1))
+    p.SetCreater(newTestCreater)
+
+    _, err := p.Handshake()
+    assert.Nil(t, err, "pool: handshake err")
+    assert.Equal(t, 1, p.OpenSize(), "pool: open size err")
+
+    // 未认证的连接给新分区使用
+    conn, err := p.Get(ConnKey{User: "test"})
+    assert.Nil(t, err, "pool: conn err")
+    assert.NotNil(t, conn, "pool: conn is nil")
+    assert.Equal(t, 1, p.OpenSize(), "pool: open size err")
+}
+
+func TestPrefill(t *testing.T) {
+    option := newOption(3)
+    option.User = "proxy"
+    option.Prefill = 2
+    p := NewPool(option)
+    p.SetCreater(newTestCreater)
+
+    err := p.Prefill()
+    assert.Nil(t, err, "pool: prefill err")
+    assert.Equal(t, 2, p.OpenSize(), "pool: open size err")
+
+    // 代理管理账号时不按用户分区
+    key := p.Key(protocol.HandshakeResponse{User: "app", Capability: prefillCapability | protocol.CLIENT_PROTOCOL_41}, nil)
+    conn, err := p.Get(key)
+    assert.Nil(t, err, "pool: conn err")
+    assert.NotNil(t, conn, "pool: conn is nil")
+    assert.Equal(t, 2, p.OpenSize(), "pool: prefilled conn not reused")
+}
+
+func TestPutReset(t *testing.T) {
+    option := newOption(1)
+    option.Reset = ResetConnection
+    p := NewPool(option)
+    p.SetCreater(newTestCreater)
+
+    conn, err := p.Get(ConnKey{User: "test"})
+    assert.Nil(t, err, "pool: conn err")
+    assert.Nil(t, p.Put(conn), "pool: put err")
+    assert.Equal(t, 1, conn.(*MysqlTestConn).resets, "pool: conn not reset")
+
+    conn2, err := p.Get(ConnKey{User: "test"})
+    assert.Nil(t, err, "pool: conn2 err")
+    assert.Equal(t, conn, conn2, "pool: conn not reused")
+
+    // 重置失败时关闭连接
+    conn2.(*MysqlTestConn).resetErr = &protocol.SQLError{Code: protocol.ER_UNKNOWN_COM_ERROR}
+    assert.ErrorIs(t, p.Put(conn2), ErrResetSession, "pool: put err")
+    assert.True(t, conn2.Closed(), "pool: conn not closed")
+    assert.Equal(t, 0, p.OpenSize(), "pool: open size err")
+
+    // 不支持 COM_RESET_CONNECTION 时之后的连接不再重置
+    conn3, err := p.Get(ConnKey{User: "test"})
+    assert.Nil(t, err, "pool: conn3 err")
+    assert.Nil(t, p.Put(conn3), "pool: put err")
+    assert.Zero(t, conn3.(*MysqlTestConn).resets, "pool: reset not disabled")
+    assert.False(t, conn3.Closed(), "pool: conn closed")
+}
+
+// 代理管理账号时不能重置的连接使用 COM_CHANGE_USER
+func TestPutResetChangeUser(t *testing.T) {
+    option := newOption(1)
+    option.Reset = ResetConnection
+    option.User = "proxy"
+    p := NewPool(option)
+    p.SetCreater(newTestCreater)
+
+    conn, err := p.Get(ConnKey{Charset: 45})
+    assert.Nil(t, err, "pool: conn err")
+    conn.(*MysqlTestConn).resetErr = &protocol.SQLError{Code: protocol.ER_UNKNOWN_COM_ERROR}
+    assert.Nil(t, p.Put(conn), "pool: put err")
+    assert.Equal(t, 1, conn.(*MysqlTestConn).changeUsers, "pool: change user not used")
+    assert.False(t, conn.Closed(), "pool: conn closed")
+
+    // 没有连接数据库时不能用 COM_INIT_DB 清除客户端切换的数据库
+    conn, err = p.Get(ConnKey{Charset: 45})
+    assert.Nil(t, err, "pool: conn err")
+    conn.(*MysqlTestConn).resets = 0
+    assert.Nil(t, p.PutSession(conn, true), "pool: put err")
+    assert.Equal(t, 2, conn.(*MysqlTestConn).changeUsers, "pool: change user not used")
+    assert.Zero(t, conn.(*MysqlTestConn).resets, "pool: conn reset")
+}
+
+// 客户端切换过数据库时恢复连接的数据库, 没有切换时只重置会话
+func TestPutResetDatabase(t *testing.T) {
+    option := newOption(1)
+    option.Reset = ResetConnection
+    p := NewPool(option)
+    p.SetCreater(newTestCreater)
+
+    key := ConnKey{User: "test", Database: "app"}
+    conn, err := p.Get(key)
+    assert.Nil(t, err, "pool: conn err")
+    assert.Nil(t, p.Put(conn), "pool: put err")
+    assert.Equal(t, "", conn.(*MysqlTestConn).resetDatabase, "pool: init db sent")
+
+    conn, err = p.Get(key)
+    assert.Nil(t, err, "pool: conn err")
+    assert.Nil(t, p.PutSession(conn, true), "pool: put err")
+    assert.Equal(t, "app", conn.(*MysqlTestConn).resetDatabase, "pool: database not restored")
+    assert.Empty(t, conn.(*MysqlTestConn).writes, "pool: current database queried")
+}
+
+// 透传认证时不能清除当前数据库, 连接放到当前数据库的分区
+func TestPutResetNoDatabase(t *testing.T) {
+    option := newOption(1)
+    option.Reset = ResetConnection
+    p := NewPool(option)
+    p.SetCreater(newTestCreater)
+
+    conn, err := p.Get(ConnKey{User: "test"})
+    assert.Nil(t, err, "pool: conn err")
+    column := protocol.ColumnDefinition{Catalog: "def", Name: "DATABASE()", Type: protocol.MYSQL_TYPE_VAR_STRING}
+    eof := []byte{protocol.EOF_PACKET, 0, 0, 2, 0}
+    conn.(*MysqlTestConn).reads = []protocol.Packet{
+        {Payload: []byte{1}, SeqId: 1},
+        {Payload: column.Encode(), SeqId: 2},
+        {Payload: eof, SeqId: 3},
+        {Payload: protocol.AppendLenEncString(nil, []byte("app")), SeqId: 4},
+        {Payload: eof, SeqId: 5},
+    }
+    assert.Nil(t, p.PutSession(conn, true), "pool: put err")
+    assert.False(t, conn.Closed(), "pool: conn closed")
+
+    conn2, err := p.Get(ConnKey{User: "test", Database: "app"})
+    assert.Nil(t, err, "pool: conn2 err")
+    assert.Equal(t, conn, conn2, "pool: conn not moved to current database")
+    assert.Equal(t, 1, p.OpenSize(), "pool: open size err")
+}
+
 func newOption(num int) PoolOption {
     option := PoolOption{
         Host: "127.0.0.1",
@@ -67,31 +245,67 @@ func newOption(num int) PoolOption {
     return option
 }
 
+var testConnId int
+
 func newTestCreater(address string) (protocol.Connector, error) {
-    c := &MysqlTestConn{}
+    testConnId++
+    c := &MysqlTestConn{id: testConnId}
     return c, nil
 }
 
 func (m *MysqlTestConn) ReadPacket() (protocol.Packet, error) {
     p := protocol.Packet{}
+    if len(m.reads) > 0 {
+        p, m.reads = m.reads[0], m.reads[1:]
+    }
     return p, nil
 }
-func (m *MysqlTestConn) WritePacket(protocol.Packet) error  {
+func (m *MysqlTestConn) WritePacket(p protocol.Packet) error  {
+    m.writes = append(m.writes, p)
     return nil
 }
-func (m *MysqlTestConn) Auth(protocol.Connector) error {
+func (m *MysqlTestConn) Handshake() (protocol.Handshake, error) {
+    return protocol.Handshake{AuthData: make([]byte, 20)}, nil
+}
+func (m *MysqlTestConn) Auth(client protocol.Connector, login *protocol.Login) error {
+    m.auths++
+    if m.authErr != nil {
+        // 已登录的连接上 COM_CHANGE_USER 失败时 mysql 断开连接
+        m.authenticated = m.authenticated && login.Verified
+        return m.authErr
+    }
+    m.authenticated = true
+    return nil
+}
+func (m *MysqlTestConn) Capability() uint32 {
+    return m.capability
+}
+func (m *MysqlTestConn) Authenticated() bool {
+    return m.authenticated
+}
+func (m *MysqlTestConn) Connect(protocol.Account) error {
+    return nil
+}
+func (m *MysqlTestConn) Reset(database string) error {
+    m.resets++
+    m.resetDatabase = database
+    return m.resetErr
+}
+func (m *MysqlTestConn) ChangeUser(protocol.Account) error {
+    m.changeUsers++
     return nil
 }
 func (m *MysqlTestConn) TransportCmdResp(protocol.Connector) error {
     return nil
 }
 func (m *MysqlTestConn) Closed() bool {
-    return false
+    return m.closed
 }
 func (m *MysqlTestConn) Expired(time.Duration) bool {
     return false
 }
 func (m *MysqlTestConn) RefreshUseTime() {}
 func (m *MysqlTestConn) Close() error {
+    m.closed = true
     return nil
 }
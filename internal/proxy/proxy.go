@@ -2,60 +2,108 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
-	"os"
 	"sync/atomic"
 	"time"
 
 	"github.com/lyuangg/umyproxy/protocol"
 )
 
+// 客户端在事务中断开时的处理方式
+const (
+	// 回滚事务后放回连接池
+	TxAbortRollback = "rollback"
+	// 关闭 mysql 连接
+	TxAbortClose = "close"
+)
+
 type (
 	Proxy struct {
-		server     net.Listener
-		pool       *Pool
-		socketFile string
+		server       net.Listener
+		tcpServer    net.Listener
+		pool         *Pool
+		credentials  *credentials
+		socketFile   string
+		socketOption SocketOption
+		// 额外监听的 tcp 地址
+		listenAddr string
+		// 客户端 TLS 使用的证书, 为空时不支持 SSL
+		tlsConfig *tls.Config
+		// 允许访问 unix socket 的客户端
+		peerAllow PeerAllow
+		// 拒绝 LOAD DATA LOCAL INFILE
+		noLocalInfile bool
+		// 代理加在 COM_QUERY 中发给 mysql 的 query attributes
+		queryAttrs protocol.QueryAttributes
+		txAbort    string
 		debug      bool
 		inShutdown uint32
+		connId     uint32
 	}
 )
 
 func NewProxy(p *Pool, socketfile string) *Proxy {
 	return &Proxy{
-		pool:       p,
-		socketFile: socketfile,
+		pool:         p,
+		credentials:  newCredentials(p.option.MaxLifetime),
+		socketFile:   socketfile,
+		socketOption: DefaultSocketOption,
 	}
 }
 
-func (p *Proxy) Run() {
-	p.deleteSocketFile()
+func (p *Proxy) Run() error {
+	if err := p.prepareSocket(); err != nil {
+		return err
+	}
 
 	serv, err := net.Listen("unix", p.socketFile)
 	if err != nil {
-		log.Fatalln("Listen err:", err)
+		return fmt.Errorf("listen err: %w", err)
 	}
-	
-	
-	// Set socket file permissions
-	perm := os.FileMode(0777)
-	err = os.Chmod(p.socketFile, perm)
-	if err != nil {
-		panic(err)
+	if err := p.chownSocket(); err != nil {
+		serv.Close()
+		return err
 	}
-	
 	p.server = serv
+
+	if p.listenAddr != "" {
+		p.tcpServer, err = net.Listen("tcp", p.listenAddr)
+		if err != nil {
+			serv.Close()
+			return fmt.Errorf("listen err: %w", err)
+		}
+	}
 	p.startPrint()
 
+	if err := p.pool.Prefill(); err != nil {
+		log.Println("prefill pool err:", err)
+	}
+
+	errCh := make(chan error, 2)
+	if p.tcpServer != nil {
+		go func() {
+			errCh <- p.serve(p.tcpServer)
+		}()
+	}
+	go func() {
+		errCh <- p.serve(p.server)
+	}()
+	return <-errCh
+}
+
+func (p *Proxy) serve(l net.Listener) error {
 	for {
-		conn, err := p.server.Accept()
+		conn, err := l.Accept()
 		if p.shuttingDown() {
 			log.Println("shutting down...")
-			return
+			return nil
 		}
 		if err != nil {
-			log.Fatalln("conn err:", err)
-			return
+			return fmt.Errorf("accept err: %w", err)
 		}
 		p.debugPrintf("accept conn")
 
@@ -63,6 +111,41 @@ func (p *Proxy) Run() {
 	}
 }
 
+// 设置 unix socket 文件的权限
+func (p *Proxy) SetSocketOption(option SocketOption) {
+	p.socketOption = option
+}
+
+// 同时监听 tcp 地址
+func (p *Proxy) SetListen(addr string) {
+	p.listenAddr = addr
+}
+
+// 设置客户端 TLS 使用的证书
+func (p *Proxy) SetTLS(config *tls.Config) {
+	p.tlsConfig = config
+}
+
+// 设置允许访问 unix socket 的客户端
+func (p *Proxy) SetPeerAllow(allow PeerAllow) {
+	p.peerAllow = allow
+}
+
+// 设置客户端在事务中断开时的处理方式
+func (p *Proxy) SetTxAbort(mode string) {
+	p.txAbort = mode
+}
+
+// 拒绝 LOAD DATA LOCAL INFILE, 不向客户端和 mysql 声明 CLIENT_LOCAL_FILES
+func (p *Proxy) RefuseLocalInfile() {
+	p.noLocalInfile = true
+}
+
+// 设置客户端登录使用的本地用户
+func (p *Proxy) SetUsers(users map[string]protocol.Credential) {
+	p.credentials.Load(users)
+}
+
 func (p *Proxy) SetDebug() {
 	p.debug = true
 	p.debugPrintf("debug mode")
@@ -77,74 +160,355 @@ func (p *Proxy) debugPrintf(format string, v ...interface{}) {
 
 func (p *Proxy) startPrint() {
 	log.Println("start server: ", p.socketFile)
+	if p.tcpServer != nil {
+		log.Println("listen:", p.tcpServer.Addr())
+		log.Println("tls:", p.tlsConfig != nil)
+	}
 	log.Println("host:", p.pool.option.Host)
 	log.Println("port:", p.pool.option.Port)
 	log.Println("pool_size:", p.pool.option.PoolMaxSize)
 	log.Println("conn_maxlifetime:", p.pool.option.MaxLifetime)
 	log.Println("wait_timeout:", p.pool.option.WaitTimeout)
+	log.Println("reset:", p.pool.option.Reset)
+	log.Println("mode:", p.pool.option.Mode)
+	if p.pool.option.Managed() {
+		log.Println("mysql user:", p.pool.option.User)
+		log.Println("prefill:", p.pool.option.Prefill)
+	}
 }
 
 func (p *Proxy) HandleConn(conn net.Conn) {
 	client := protocol.NewConn(conn)
 	defer client.Close()
 
-	mysqlServ, err := p.Get()
+	// unix socket 客户端的身份
+	peer, err := GetPeerCred(conn)
+	peerName := conn.RemoteAddr().String()
+	if peer != nil {
+		peerName = peer.String()
+	}
 	if err != nil {
-		log.Printf("get mysql conn err: %+v \n", err)
+		log.Printf("[%s] %+v \n", peerName, err)
+	}
+	if !p.peerAllowed(conn, peer) {
+		msg := fmt.Sprintf("Peer %s is not allowed to connect to this proxy", peerName)
+		client.WritePacket(protocol.NewErrPacket(protocol.ER_HOST_NOT_PRIVILEGED, "HY000", msg, 0))
+		log.Printf("[%s] peer not allowed \n", peerName)
 		return
 	}
-	p.debugPrintf("get mysql conn")
-	defer p.Put(mysqlServ)
+	p.debugPrintf("[%s] accept peer", peerName)
 
 	// 认证
-	if err := mysqlServ.Auth(client); err != nil {
-		log.Printf("mysql auth err: %+v \n", err)
+	session := &protocol.Session{}
+	mysqlServ, key, err := p.auth(client, peer, session)
+	if err != nil {
+		log.Printf("[%s] mysql auth err: %+v \n", peerName, err)
 		return
 	}
-	p.debugPrintf("client auth success")
+	p.debugPrintf("[%s] client auth success", peerName)
+	defer func() {
+		if mysqlServ != nil {
+			p.release(mysqlServ, session, peerName)
+		}
+	}()
+
+	// transaction 模式下认证后先放回连接池, 执行命令时再获取
+	txMode := p.pool.option.Mode == PoolModeTransaction
+	pinned := false
+	// 预处理语句使用虚拟 id, 发送 COM_STMT_SEND_LONG_DATA 之后需要在同一个连接上执行, 执行包中也没有这些参数的值
+	stmts := newClientStmts()
+	longData := false
+	// 获取连接失败时暂存的 COM_STMT_SEND_LONG_DATA, 在下一个命令前发送
+	var pendingLongData []protocol.Packet
+	if txMode {
+		p.pool.put(mysqlServ)
+		mysqlServ = nil
+	}
 
 	// 发送命令
 	for {
 		cmd, err := client.ReadPacket()
 
 		if err != nil {
-			log.Println("read cmd err: ", err)
+			log.Printf("[%s] read cmd err: %+v \n", peerName, err)
 			return
 		}
 
-		p.debugPrintf("read cmd: %+v", cmd)
+		p.debugPrintf("read cmd: %s %+v", protocol.CommandName(cmd.Command()), cmd)
+		session.Attributes = nil
 
 		if protocol.IsQuitPacket(cmd) {
 			p.debugPrintf("client quit")
 			return
 		}
 
-		err = mysqlServ.WritePacket(cmd)
+		if mysqlServ == nil {
+			mysqlServ, err = p.Get(key)
+			if err != nil {
+				log.Printf("[%s] get mysql conn err: %+v \n", peerName, err)
+				// COM_STMT_CLOSE 和 COM_STMT_SEND_LONG_DATA 没有响应, 不能返回 ERR
+				switch cmd.Command() {
+				case protocol.COM_STMT_CLOSE:
+					p.virtualStatement(client, nil, session, stmts, cmd)
+				case protocol.COM_STMT_SEND_LONG_DATA:
+					pendingLongData = append(pendingLongData, cmd)
+				default:
+					client.WritePacket(protocol.NewErrPacket(protocol.ER_CON_COUNT_ERROR, "08004", "Too many connections", 1))
+				}
+				continue
+			}
+		}
+		for _, data := range pendingLongData {
+			data, forward, err := p.virtualStatement(client, mysqlServ, session, stmts, data)
+			if err != nil {
+				log.Printf("[%s] prepared statement err: %+v \n", peerName, err)
+				mysqlServ.Close()
+				return
+			}
+			if !forward {
+				continue
+			}
+			if err := mysqlServ.WritePacket(data); err != nil {
+				log.Printf("write cmd to server err: %+v \n", err)
+				return
+			}
+			longData = true
+		}
+		pendingLongData = nil
+		if txMode && !pinned {
+			if reason := pinReason(session, cmd); reason != "" {
+				pinned = true
+				p.debugPrintf("[%s] pin mysql conn: %s", peerName, reason)
+			}
+		}
+
+		forward := true
+		if txMode {
+			cmd, forward, err = p.virtualStatement(client, mysqlServ, session, stmts, cmd)
+			if err != nil {
+				log.Printf("[%s] prepared statement err: %+v \n", peerName, err)
+				mysqlServ.Close()
+				return
+			}
+		}
+
+		if forward {
+			if changesDatabase(session, cmd) {
+				session.DatabaseChanged = true
+			}
+			cmd, err = p.queryAttributes(session, mysqlServ, cmd, longData)
+			if err != nil {
+				log.Printf("[%s] query attributes err: %+v \n", peerName, err)
+				mysqlServ.Close()
+				return
+			}
+			if len(session.Attributes) > 0 {
+				p.debugPrintf("[%s] query attributes: %s", peerName, formatAttributes(session.Attributes))
+			}
+			session.ReleaseStatements(cmd)
+			err = mysqlServ.WritePacket(cmd)
+			if err != nil {
+				log.Printf("write cmd to server err: %+v \n", err)
+				return
+			}
+
+			// response
+			resp := protocol.NewResponse(mysqlServ, cmd.Command(), session)
+			err = resp.ResponsePacket(client)
+			p.debugPrintf("transport response")
+			if err != nil {
+				// 响应没有读完, mysql 连接不能复用
+				log.Printf("[%s] transport response err: %+v \n", peerName, err)
+				mysqlServ.Close()
+				return
+			}
+			p.debugPrintf("end transport response")
+		}
+		switch cmd.Command() {
+		case protocol.COM_STMT_SEND_LONG_DATA:
+			longData = true
+		case protocol.COM_STMT_EXECUTE, protocol.COM_STMT_RESET, protocol.COM_STMT_CLOSE:
+			longData = false
+		}
+
+		if !txMode || pinned {
+			continue
+		}
+		if _, ok := session.Attributes.Get(PinAttribute); ok {
+			pinned = true
+			p.debugPrintf("[%s] pin mysql conn: query attribute %s", peerName, PinAttribute)
+			continue
+		}
+		// 服务端报告会话状态变化时 (CLIENT_SESSION_TRACK) 同样固定连接
+		if session.Status&protocol.SERVER_SESSION_STATE_CHANGED != 0 {
+			pinned = true
+			p.debugPrintf("[%s] pin mysql conn: session state changed", peerName)
+			continue
+		}
+		if session.Idle() && !longData {
+			p.pool.put(mysqlServ)
+			mysqlServ = nil
+		}
+	}
+
+}
+
+// 客户端断开时还在事务中, 回滚或关闭连接后再放回连接池
+func (p *Proxy) release(server protocol.Connector, session *protocol.Session, peerName string) {
+	if session.InTransaction() && !server.Closed() {
+		if p.txAbort == TxAbortClose {
+			log.Printf("[%s] client disconnected in transaction, close mysql conn \n", peerName)
+			server.Close()
+		} else if _, err := protocol.Exec(server, "ROLLBACK"); err != nil {
+			log.Printf("[%s] client disconnected in transaction, rollback err: %+v \n", peerName, err)
+			server.Close()
+		} else {
+			log.Printf("[%s] client disconnected in transaction, rollback \n", peerName)
+		}
+	}
+
+	// 关闭客户端没有关闭的预处理语句, 避免连接池中的连接超过 max_prepared_stmt_count
+	for _, id := range session.Statements() {
+		if server.Closed() {
+			break
+		}
+		if err := protocol.CloseStatement(server, id); err != nil {
+			log.Printf("[%s] close statement %d err: %+v \n", peerName, id, err)
+			server.Close()
+		}
+	}
+	p.putSession(server, session.DatabaseChanged)
+}
+
+// 只限制 unix socket 客户端, 读取身份失败时拒绝
+func (p *Proxy) peerAllowed(conn net.Conn, peer *PeerCred) bool {
+	if p.peerAllow.Empty() {
+		return true
+	}
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return true
+	}
+	return peer != nil && p.peerAllow.Allowed(*peer)
+}
+
+// 与客户端握手, 按客户端身份从连接池获取连接并认证, 协商的 capability 记录到 session
+func (p *Proxy) auth(client protocol.Connector, peer *PeerCred, session *protocol.Session) (protocol.Connector, ConnKey, error) {
+	hs, err := p.pool.Handshake()
+	if err != nil {
+		return nil, ConnKey{}, fmt.Errorf("get handshake err: %w", err)
+	}
+
+	// 每个客户端使用新的 scramble 和连接 id
+	hs.AuthData, err = protocol.NewScramble()
+	if err != nil {
+		return nil, ConnKey{}, fmt.Errorf("new scramble err: %w", err)
+	}
+	hs.ConnectionId = atomic.AddUint32(&p.connId, 1)
+
+	// 配置了证书时才支持 tcp 客户端的 SSL
+	caps := protocol.Capabilities{SSL: p.tlsConfig != nil && !protocol.IsSecure(client)}
+	if p.noLocalInfile {
+		caps.Disabled |= protocol.CLIENT_LOCAL_FILES
+	}
+	hs.Capability = caps.Handshake(hs.Capability)
+
+	// send init packet
+	err = client.WritePacket(protocol.Packet{Payload: hs.Encode()})
+	if err != nil {
+		return nil, ConnKey{}, fmt.Errorf("send init err: %w", err)
+	}
+
+	// read auth packet
+	authPacket, err := client.ReadPacket()
+	if err != nil {
+		return nil, ConnKey{}, fmt.Errorf("read auth packet err: %w", err)
+	}
+
+	// 客户端请求 SSL, 升级后再读取认证包
+	if protocol.IsSSLRequestPacket(authPacket) {
+		if err := protocol.AcceptTLS(client, p.tlsConfig); err != nil {
+			return nil, ConnKey{}, fmt.Errorf("client ssl err: %w", err)
+		}
+		authPacket, err = client.ReadPacket()
 		if err != nil {
-			log.Printf("write cmd to server err: %+v \n", err)
-			return
+			return nil, ConnKey{}, fmt.Errorf("read auth packet err: %w", err)
 		}
+	}
+	resp, err := protocol.ParseHandshakeResponse(authPacket.Payload)
+	if err != nil {
+		return nil, ConnKey{}, fmt.Errorf("parse auth packet err: %w", err)
+	}
+	caps.Negotiate(hs.Capability, &resp, session)
+	login := &protocol.Login{Packet: authPacket, Response: resp, Scramble: hs.AuthData}
 
-		// response
-		resp := protocol.NewResponse(mysqlServ, cmd.Payload[0])
-		err = resp.ResponsePacket(client)
-		p.debugPrintf("transport response")
+	// 校验已登录过的用户, 失败时不使用 mysql 连接
+	// 不知道密码的凭据不能校验, 由 mysql 认证
+	cred, ok := p.credentials.Get(resp.User)
+	ok = ok && cred.KnownPassword()
+	if !ok && p.pool.option.Managed() {
+		// 代理管理 mysql 账号时只允许本地用户登录
+		client.WritePacket(protocol.AccessDeniedPacket(login, login.Packet.SeqId+1))
+		return nil, ConnKey{}, fmt.Errorf("user %s: %w", resp.User, protocol.ErrAuth)
+	}
+	if ok {
+		verified, err := cred.Verify(client, login)
 		if err != nil {
-			log.Println("transport response err:", err)
-			return
+			return nil, ConnKey{}, fmt.Errorf("verify auth err: %w", err)
 		}
-		p.debugPrintf("end transport response")
+		// mysql 上的密码可能已经修改, 删除记录的凭据后重新由 mysql 认证
+		if !verified && (p.pool.option.Managed() || !p.credentials.Delete(resp.User)) {
+			client.WritePacket(protocol.AccessDeniedPacket(login, login.Packet.SeqId+1))
+			return nil, ConnKey{}, fmt.Errorf("user %s: %w", resp.User, protocol.ErrAuth)
+		}
+	}
+
+	// mysql 连接使用连接池分区的 capability 登录, 可能协商了客户端没有的 CLIENT_QUERY_ATTRIBUTES
+	key := p.pool.Key(resp, peer)
+	login.Response.Capability |= key.Capability & protocol.CLIENT_QUERY_ATTRIBUTES
+	mysqlServ, err := p.Get(key)
+	if err != nil {
+		return nil, ConnKey{}, fmt.Errorf("get mysql conn err: %w", err)
 	}
+	p.debugPrintf("get mysql conn, user: %s, db: %s", resp.User, resp.Database)
 
+	// 代理不能校验的客户端在已登录的连接上使用 COM_CHANGE_USER 由 mysql 认证, 会释放连接上的预处理语句
+	changeUser := !login.Verified && protocol.IsAuthenticated(mysqlServ)
+	if err := mysqlServ.Auth(client, login); err != nil {
+		// 只是客户端认证失败时连接仍然可用
+		if !protocol.IsAuthenticated(mysqlServ) {
+			mysqlServ.Close()
+		}
+		p.Put(mysqlServ)
+		return nil, ConnKey{}, err
+	}
+	if changeUser {
+		p.pool.statements(mysqlServ).Clear()
+	}
+	// 得到明文密码后保存 stage2 hash, 之后直接校验新的 scramble
+	if !login.Verified && login.Password != nil {
+		p.credentials.Set(resp.User, protocol.NewCredential(login))
+	}
+
+	// 第一个命令只返回 ERR 时也要知道会话是否空闲
+	session.Status = protocol.AuthStatus(mysqlServ)
+	return mysqlServ, key, nil
 }
 
-func (p *Proxy) Get() (protocol.Connector, error) {
-	return p.pool.Get()
+func (p *Proxy) Get(key ConnKey) (protocol.Connector, error) {
+	return p.pool.Get(key)
 }
 
 func (p *Proxy) Put(conn protocol.Connector) error {
+	return p.putSession(conn, false)
+}
+
+func (p *Proxy) putSession(conn protocol.Connector, databaseChanged bool) error {
 	p.debugPrintf("put conn")
-	return p.pool.Put(conn)
+	err := p.pool.PutSession(conn, databaseChanged)
+	if errors.Is(err, ErrResetSession) {
+		log.Println("discard mysql conn:", err)
+	}
+	return err
 }
 
 func (p *Proxy) Shutdown(ctx context.Context) error {
@@ -157,10 +521,12 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 	defer t.Stop()
 	for {
 		if p.pool.OpenSize() <= 0 {
+			p.closeTCPServer()
 			return p.server.Close()
 		}
 		select {
 		case <-ctx.Done():
+			p.closeTCPServer()
 			p.server.Close()
 			return ctx.Err()
 		case <-t.C:
@@ -169,17 +535,15 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 	}
 }
 
+func (p *Proxy) closeTCPServer() {
+	if p.tcpServer != nil {
+		p.tcpServer.Close()
+	}
+}
+
 func (p *Proxy) shuttingDown() bool {
 	if atomic.LoadUint32(&p.inShutdown) == 1 {
 		return true
 	}
 	return false
 }
-
-func (p *Proxy) deleteSocketFile() error {
-	_, err := os.Stat(p.socketFile)
-	if err == nil || os.IsExist(err) {
-		return os.Remove(p.socketFile)
-	}
-	return err
-}
@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lyuangg/umyproxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProxy() *Proxy {
+	pool := NewPool(newOption(2))
+	pool.SetCreater(newTestCreater)
+	return NewProxy(pool, "")
+}
+
+// 自签名证书
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "generate key err")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "umyproxy.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err, "create cert err")
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestAuthNoSSL(t *testing.T) {
+	p := newTestProxy()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		defer c2.Close()
+		p.auth(protocol.NewConn(c2), nil, &protocol.Session{})
+	}()
+
+	client := protocol.NewConn(c1)
+	init, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	hs, err := protocol.ParseHandshake(init.Payload)
+	assert.Nil(t, err, "parse handshake err")
+	assert.Zero(t, hs.Capability&protocol.CLIENT_SSL, "ssl advertised without cert")
+}
+
+func TestAuthClientTLS(t *testing.T) {
+	p := newTestProxy()
+	p.SetTLS(testTLSConfig(t))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer c2.Close()
+		_, _, err := p.auth(protocol.NewConn(c2), nil, &protocol.Session{})
+		done <- err
+	}()
+
+	client := protocol.NewConn(c1)
+	init, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	hs, err := protocol.ParseHandshake(init.Payload)
+	assert.Nil(t, err, "parse handshake err")
+	assert.NotZero(t, hs.Capability&protocol.CLIENT_SSL, "ssl not advertised")
+
+	capability := protocol.CLIENT_BASIC_FLAGS | protocol.CLIENT_SSL
+	err = client.WritePacket(protocol.SSLRequestPacket(capability, 1<<24, 45, 1))
+	assert.Nil(t, err, "send ssl request err")
+	tlsConn := tls.Client(c1, &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, tlsConn.Handshake(), "tls handshake err")
+
+	resp := protocol.HandshakeResponse{Capability: capability, MaxPacketSize: 1 << 24, Charset: 45, User: "root", AuthPlugin: protocol.AUTH_NATIVE_PASSWORD}
+	err = protocol.NewConn(tlsConn).WritePacket(protocol.Packet{Payload: resp.Encode(), SeqId: 2})
+	assert.Nil(t, err, "send auth err")
+	assert.Nil(t, <-done, "auth err")
+}
+
+// 客户端使用 mysql_native_password 和 password 登录, 返回 auth 的结果
+func testLogin(t *testing.T, p *Proxy, user, password string) (protocol.Connector, error) {
+	p.pool.setHandshake(protocol.Handshake{Capability: protocol.CLIENT_BASIC_FLAGS, AuthData: make([]byte, 20), AuthPlugin: protocol.AUTH_NATIVE_PASSWORD})
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close() })
+	type result struct {
+		conn protocol.Connector
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := p.auth(protocol.NewConn(c2), nil, &protocol.Session{})
+		c2.Close()
+		done <- result{conn, err}
+	}()
+
+	client := protocol.NewConn(c1)
+	init, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	hs, err := protocol.ParseHandshake(init.Payload)
+	assert.Nil(t, err, "parse handshake err")
+	resp := protocol.HandshakeResponse{
+		Capability:   protocol.CLIENT_BASIC_FLAGS,
+		Charset:      45,
+		User:         user,
+		AuthResponse: protocol.ScramblePassword(protocol.AUTH_NATIVE_PASSWORD, hs.AuthData, []byte(password)),
+		AuthPlugin:   protocol.AUTH_NATIVE_PASSWORD,
+	}
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: resp.Encode(), SeqId: 1}), "send auth err")
+	go func() {
+		for {
+			packet, err := client.ReadPacket()
+			if err != nil {
+				return
+			}
+			// 使用新的 scramble 重新计算
+			if protocol.IsAuthSwitchPacket(packet) {
+				plugin, scramble, _ := protocol.ParseAuthSwitch(packet.Payload)
+				reply := protocol.ScramblePassword(plugin, scramble, []byte(password))
+				client.WritePacket(protocol.Packet{Payload: reply, SeqId: packet.SeqId + 1})
+			}
+		}
+	}()
+
+	r := <-done
+	return r.conn, r.err
+}
+
+// 代理不能校验的客户端在连接池中已登录的连接上由 mysql 重新认证, 不会创建新连接
+func TestAuthChangeUser(t *testing.T) {
+	p := newTestProxy()
+	conn, err := testLogin(t, p, "root", "secret")
+	assert.Nil(t, err, "first login err")
+	assert.Nil(t, p.Put(conn), "put err")
+
+	conn2, err := testLogin(t, p, "root", "secret")
+	assert.Nil(t, err, "repeat login err")
+	assert.Equal(t, conn, conn2, "authenticated conn not reused")
+	assert.Equal(t, 2, conn2.(*MysqlTestConn).auths, "mysql auth not used")
+	assert.Equal(t, 1, p.pool.OpenSize(), "open size err")
+	assert.Nil(t, p.Put(conn2), "put err")
+
+	// 修改密码后凭据不能校验, 同样由 mysql 认证
+	stale := protocol.Credential{}
+	stale.SetPassword([]byte("secret"))
+	p.credentials.Set("root", stale)
+	conn3, err := testLogin(t, p, "root", "changed")
+	assert.Nil(t, err, "stale credential login err")
+	assert.Equal(t, conn, conn3, "authenticated conn not reused")
+	assert.Equal(t, 1, p.pool.OpenSize(), "open size err")
+	_, ok := p.credentials.Get("root")
+	assert.False(t, ok, "stale credential not deleted")
+	assert.Nil(t, p.Put(conn3), "put err")
+
+	// mysql 拒绝时连接已经断开, 关闭
+	conn.(*MysqlTestConn).authErr = protocol.ErrAuth
+	_, err = testLogin(t, p, "root", "wrong")
+	assert.ErrorIs(t, err, protocol.ErrAuth)
+	assert.True(t, conn.Closed(), "rejected conn not closed")
+	assert.Equal(t, 0, p.pool.OpenSize(), "rejected conn not closed")
+}
+
+// 不使用 -user 时, 用户列表中 mysql_native_password 的 hash 也由代理校验
+func TestAuthNativeStage2Passthrough(t *testing.T) {
+	p := newTestProxy()
+	stage1 := sha1.Sum([]byte("secret"))
+	stage2 := sha1.Sum(stage1[:])
+	p.SetUsers(map[string]protocol.Credential{"root": {NativeStage2: stage2[:]}})
+
+	_, err := testLogin(t, p, "root", "wrong")
+	assert.ErrorIs(t, err, protocol.ErrAuth)
+	assert.Equal(t, 0, p.pool.OpenSize(), "mysql conn used for denied login")
+
+	conn, err := testLogin(t, p, "root", "secret")
+	assert.Nil(t, err, "login err")
+	assert.Nil(t, p.Put(conn), "put err")
+	_, ok := p.credentials.Get("root")
+	assert.True(t, ok, "static credential deleted")
+}
+
+// 只是客户端认证失败时已登录的连接放回连接池
+func TestAuthClientFailed(t *testing.T) {
+	p := newTestProxy()
+	cred := protocol.Credential{}
+	cred.SetPassword([]byte("secret"))
+	p.credentials.Load(map[string]protocol.Credential{"root": cred})
+
+	conn, err := testLogin(t, p, "root", "secret")
+	assert.Nil(t, err, "first login err")
+	assert.Nil(t, p.Put(conn), "put err")
+
+	server := conn.(*MysqlTestConn)
+	server.authErr = protocol.ErrAuth
+	_, err = testLogin(t, p, "root", "secret")
+	assert.ErrorIs(t, err, protocol.ErrAuth)
+	assert.False(t, server.Closed(), "conn closed")
+	assert.Equal(t, 1, p.pool.OpenSize(), "conn not put back")
+}
+
+func TestReleaseInTransaction(t *testing.T) {
+	p := newTestProxy()
+	conn, err := p.Get(ConnKey{User: "test"})
+	assert.Nil(t, err, "get conn err")
+
+	// 事务中断开, 回滚后放回连接池
+	session := &protocol.Session{Status: protocol.SERVER_STATUS_IN_TRANS}
+	server := conn.(*MysqlTestConn)
+	server.reads = []protocol.Packet{{Payload: []byte{protocol.OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 1}}
+	p.release(conn, session, "test")
+	assert.Len(t, server.writes, 1, "rollback not sent")
+	assert.Equal(t, append([]byte{protocol.COM_QUERY}, "ROLLBACK"...), server.writes[0].Payload, "rollback err")
+	assert.False(t, server.Closed(), "conn closed")
+	assert.Equal(t, 1, p.pool.OpenSize(), "conn not put back")
+
+	// 回滚失败时关闭连接
+	conn, err = p.Get(ConnKey{User: "test"})
+	assert.Nil(t, err, "get conn err")
+	p.release(conn, session, "test")
+	assert.True(t, conn.Closed(), "conn not closed")
+	assert.Equal(t, 0, p.pool.OpenSize(), "conn put back")
+
+	// 设置为关闭连接
+	p.SetTxAbort(TxAbortClose)
+	conn, err = p.Get(ConnKey{User: "test"})
+	assert.Nil(t, err, "get conn err")
+	p.release(conn, session, "test")
+	assert.Empty(t, conn.(*MysqlTestConn).writes, "rollback sent")
+	assert.True(t, conn.Closed(), "conn not closed")
+}
+
+func TestReleaseStatements(t *testing.T) {
+	p := newTestProxy()
+	conn, err := p.Get(ConnKey{User: "test"})
+	assert.Nil(t, err, "get conn err")
+
+	// 没有关闭的预处理语句在放回连接池前关闭
+	session := &protocol.Session{}
+	session.AddStatement(1, 0)
+	session.AddStatement(3, 0)
+	p.release(conn, session, "test")
+
+	server := conn.(*MysqlTestConn)
+	assert.Equal(t, []protocol.Packet{
+		{Payload: []byte{protocol.COM_STMT_CLOSE, 1, 0, 0, 0}},
+		{Payload: []byte{protocol.COM_STMT_CLOSE, 3, 0, 0, 0}},
+	}, server.writes, "statements not closed")
+	assert.Equal(t, 1, p.pool.OpenSize(), "conn not put back")
+}
+
+func TestTransactionMode(t *testing.T) {
+	option := newOption(1)
+	option.Mode = PoolModeTransaction
+	pool := NewPool(option)
+	p := NewProxy(pool, "")
+
+	// mysql 连接按顺序返回 OK 包中的状态
+	statuses := []uint16{
+		protocol.SERVER_STATUS_AUTOCOMMIT,
+		protocol.SERVER_STATUS_AUTOCOMMIT | protocol.SERVER_STATUS_IN_TRANS,
+		protocol.SERVER_STATUS_AUTOCOMMIT,
+		protocol.SERVER_STATUS_AUTOCOMMIT,
+	}
+	pool.SetCreater(func(address string) (protocol.Connector, error) {
+		conn, _ := newTestCreater(address)
+		for _, status := range statuses {
+			ok := protocol.Packet{Payload: []byte{protocol.OK_PACKET, 0, 0, byte(status), byte(status >> 8), 0, 0}, SeqId: 1}
+			conn.(*MysqlTestConn).reads = append(conn.(*MysqlTestConn).reads, ok)
+		}
+		return conn, nil
+	})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go p.HandleConn(c2)
+
+	client := protocol.NewConn(c1)
+	_, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	resp := protocol.HandshakeResponse{Capability: protocol.CLIENT_BASIC_FLAGS, Charset: 45, User: "root", AuthPlugin: protocol.AUTH_NATIVE_PASSWORD}
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: resp.Encode(), SeqId: 1}), "send auth err")
+
+	idle := func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.freeConn[pool.Key(resp, nil)]) == 1
+	}
+	assert.Eventually(t, idle, time.Second, time.Millisecond, "conn not released after auth")
+
+	for _, c := range []struct {
+		query    string
+		released bool
+	}{
+		{"SELECT 1", true},
+		{"BEGIN", false},
+		{"COMMIT", true},
+		{"SET @a = 1", false},
+	} {
+		err := client.WritePacket(protocol.Packet{Payload: append([]byte{protocol.COM_QUERY}, c.query...)})
+		assert.Nil(t, err, "send query err")
+		_, err = client.ReadPacket()
+		assert.Nil(t, err, "read result err")
+		if c.released {
+			assert.Eventually(t, idle, time.Second, time.Millisecond, "conn not released: %s", c.query)
+		} else {
+			assert.Never(t, idle, 20*time.Millisecond, time.Millisecond, "conn released: %s", c.query)
+		}
+	}
+}
+
+// 带有 umyproxy.pin attribute 的命令固定 mysql 连接
+func TestTransactionModePinAttribute(t *testing.T) {
+	option := newOption(1)
+	option.Mode = PoolModeTransaction
+	pool := NewPool(option)
+	p := NewProxy(pool, "")
+	capability := protocol.CLIENT_BASIC_FLAGS | protocol.CLIENT_QUERY_ATTRIBUTES
+	pool.setHandshake(protocol.Handshake{Capability: capability, AuthData: make([]byte, 20), AuthPlugin: protocol.AUTH_NATIVE_PASSWORD})
+	pool.SetCreater(func(address string) (protocol.Connector, error) {
+		conn, _ := newTestCreater(address)
+		conn.(*MysqlTestConn).capability = capability
+		ok := protocol.Packet{Payload: []byte{protocol.OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 1}
+		conn.(*MysqlTestConn).reads = []protocol.Packet{ok, ok}
+		return conn, nil
+	})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go p.HandleConn(c2)
+
+	client := protocol.NewConn(c1)
+	_, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	resp := protocol.HandshakeResponse{Capability: capability, Charset: 45, User: "root", AuthPlugin: protocol.AUTH_NATIVE_PASSWORD}
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: resp.Encode(), SeqId: 1}), "send auth err")
+
+	idle := func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.freeConn[pool.Key(resp, nil)]) == 1
+	}
+	assert.Eventually(t, idle, time.Second, time.Millisecond, "conn not released after auth")
+
+	for _, q := range []protocol.Query{
+		{Attributes: protocol.QueryAttributes{protocol.StringAttribute("trace_id", "abc")}, Query: "SELECT 1"},
+		{Attributes: protocol.QueryAttributes{protocol.StringAttribute(PinAttribute, "1")}, Query: "SELECT 1"},
+	} {
+		err := client.WritePacket(protocol.Packet{Payload: q.Encode(capability)})
+		assert.Nil(t, err, "send query err")
+		_, err = client.ReadPacket()
+		assert.Nil(t, err, "read result err")
+		if _, pin := q.Attributes.Get(PinAttribute); pin {
+			assert.Never(t, idle, 20*time.Millisecond, time.Millisecond, "pinned conn released")
+		} else {
+			assert.Eventually(t, idle, time.Second, time.Millisecond, "conn not released")
+		}
+	}
+}
+
+// 第一个命令只返回 ERR 时会话仍然是空闲的, 连接放回连接池
+func TestTransactionModeFirstErr(t *testing.T) {
+	option := newOption(1)
+	option.Mode = PoolModeTransaction
+	pool := NewPool(option)
+	p := NewProxy(pool, "")
+	pool.SetCreater(func(address string) (protocol.Connector, error) {
+		conn, _ := newTestCreater(address)
+		errPacket := protocol.NewErrPacket(1146, "42S02", "Table 'test.t' doesn't exist", 1)
+		conn.(*MysqlTestConn).reads = []protocol.Packet{errPacket}
+		return conn, nil
+	})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go p.HandleConn(c2)
+
+	client := protocol.NewConn(c1)
+	_, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	resp := protocol.HandshakeResponse{Capability: protocol.CLIENT_BASIC_FLAGS, Charset: 45, User: "root", AuthPlugin: protocol.AUTH_NATIVE_PASSWORD}
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: resp.Encode(), SeqId: 1}), "send auth err")
+
+	idle := func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.freeConn[pool.Key(resp, nil)]) == 1
+	}
+	assert.Eventually(t, idle, time.Second, time.Millisecond, "conn not released after auth")
+
+	err = client.WritePacket(protocol.Packet{Payload: append([]byte{protocol.COM_QUERY}, "SELECT * FROM t"...)})
+	assert.Nil(t, err, "send query err")
+	result, err := client.ReadPacket()
+	assert.Nil(t, err, "read result err")
+	assert.True(t, protocol.IsErrPacket(result), "err packet not forwarded")
+	assert.Eventually(t, idle, time.Second, time.Millisecond, "conn pinned after err")
+}
+
+// 获取不到连接时 COM_STMT_CLOSE 和 COM_STMT_SEND_LONG_DATA 没有响应, 长数据在下一个命令前发送
+func TestTransactionModeNoConn(t *testing.T) {
+	option := newOption(1)
+	option.Mode = PoolModeTransaction
+	pool := NewPool(option)
+	p := NewProxy(pool, "")
+
+	// 预处理 1 个参数的语句, 然后是 COM_STMT_RESET 的 OK 包
+	ok := protocol.Packet{Payload: []byte{protocol.OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 1}
+	reads := []protocol.Packet{
+		{Payload: []byte{protocol.OK_PACKET, 7, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}, SeqId: 1},
+		{Payload: protocol.ColumnDefinition{Catalog: "def", Name: "?", Type: protocol.MYSQL_TYPE_VAR_STRING}.Encode(), SeqId: 2},
+		{Payload: []byte{protocol.EOF_PACKET, 0, 0, 2, 0}, SeqId: 3},
+		ok,
+	}
+	var server *MysqlTestConn
+	pool.SetCreater(func(address string) (protocol.Connector, error) {
+		conn, _ := newTestCreater(address)
+		server = conn.(*MysqlTestConn)
+		server.reads = reads
+		return conn, nil
+	})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go p.HandleConn(c2)
+
+	client := protocol.NewConn(c1)
+	_, err := client.ReadPacket()
+	assert.Nil(t, err, "read handshake err")
+	resp := protocol.HandshakeResponse{Capability: protocol.CLIENT_BASIC_FLAGS, Charset: 45, User: "root", AuthPlugin: protocol.AUTH_NATIVE_PASSWORD}
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: resp.Encode(), SeqId: 1}), "send auth err")
+
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: append([]byte{protocol.COM_STMT_PREPARE}, "SELECT ?"...)}), "send prepare err")
+	for i := 0; i < 3; i++ {
+		_, err = client.ReadPacket()
+		assert.Nil(t, err, "read prepare response err")
+	}
+
+	// 其他客户端占用唯一的连接
+	key := pool.Key(resp, nil)
+	idle := func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return len(pool.freeConn[key]) == 1
+	}
+	assert.Eventually(t, idle, time.Second, time.Millisecond, "conn not released after prepare")
+	held, err := pool.Get(key)
+	assert.Nil(t, err, "get conn err")
+
+	longData := protocol.Packet{Payload: []byte{protocol.COM_STMT_SEND_LONG_DATA, 1, 0, 0, 0, 0, 0, 'x'}}
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: []byte{protocol.COM_STMT_CLOSE, 2, 0, 0, 0}}), "send close err")
+	assert.Nil(t, client.WritePacket(longData), "send long data err")
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: []byte{protocol.COM_PING}}), "send ping err")
+	result, err := client.ReadPacket()
+	assert.Nil(t, err, "read ping result err")
+	assert.Equal(t, protocol.ER_CON_COUNT_ERROR, protocol.ParseErrPacket(result).Code, "ping result err")
+
+	// 连接可用后先发送暂存的长数据
+	pool.put(held)
+	assert.Nil(t, client.WritePacket(protocol.Packet{Payload: []byte{protocol.COM_STMT_RESET, 1, 0, 0, 0}}), "send reset err")
+	result, err = client.ReadPacket()
+	assert.Nil(t, err, "read reset result err")
+	assert.True(t, protocol.IsOkPacket(result), "reset result err")
+	assert.Equal(t, []protocol.Packet{
+		{Payload: append([]byte{protocol.COM_STMT_PREPARE}, "SELECT ?"...)},
+		{Payload: []byte{protocol.COM_STMT_SEND_LONG_DATA, 7, 0, 0, 0, 0, 0, 'x'}},
+		{Payload: []byte{protocol.COM_STMT_RESET, 7, 0, 0, 0}},
+	}, server.writes, "long data not sent before reset")
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	// unix socket 文件的权限
+	SocketOption struct {
+		// 用户和用户组, 可以是名称或数字 id, 为空时不修改
+		Owner string
+		Group string
+		Mode  os.FileMode
+		// 目录不存在时创建
+		MkdirAll bool
+	}
+)
+
+// 默认与之前的版本相同, 所有用户都可以连接
+var DefaultSocketOption = SocketOption{Mode: 0777}
+
+// 监听前检查 socket 文件, 已有代理在使用时返回错误, 只删除残留的 socket 文件
+func (p *Proxy) prepareSocket() error {
+	if p.socketOption.MkdirAll {
+		if err := os.MkdirAll(filepath.Dir(p.socketFile), 0755); err != nil {
+			return fmt.Errorf("create socket dir err: %w", err)
+		}
+	}
+
+	fi, err := os.Lstat(p.socketFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat socket file err: %w", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s", ErrNotSocket, p.socketFile)
+	}
+
+	conn, err := net.DialTimeout("unix", p.socketFile, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", ErrSocketInUse, p.socketFile)
+	}
+
+	if err := os.Remove(p.socketFile); err != nil {
+		return fmt.Errorf("remove socket file err: %w", err)
+	}
+	return nil
+}
+
+// 设置 socket 文件的用户、用户组和权限
+func (p *Proxy) chownSocket() error {
+	uid, gid := -1, -1
+	if p.socketOption.Owner != "" {
+		id, err := lookupUid(p.socketOption.Owner, false)
+		if err != nil {
+			return fmt.Errorf("lookup socket owner err: %w", err)
+		}
+		uid = int(id)
+	}
+	if p.socketOption.Group != "" {
+		id, err := lookupGid(p.socketOption.Group, false)
+		if err != nil {
+			return fmt.Errorf("lookup socket group err: %w", err)
+		}
+		gid = int(id)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(p.socketFile, uid, gid); err != nil {
+			return fmt.Errorf("chown socket file err: %w", err)
+		}
+	}
+
+	if err := os.Chmod(p.socketFile, p.socketOption.Mode); err != nil {
+		return fmt.Errorf("chmod socket file err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareSocket(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProxy()
+	p.socketFile = filepath.Join(dir, "run", "umyproxy.socket")
+
+	// 创建目录
+	assert.NotNil(t, p.Run(), "socket dir not exists")
+	p.SetSocketOption(SocketOption{Mode: 0660, MkdirAll: true})
+	assert.Nil(t, p.prepareSocket(), "prepare socket err")
+
+	// 正在使用的 socket
+	l, err := net.Listen("unix", p.socketFile)
+	assert.Nil(t, err, "listen err")
+	assert.ErrorIs(t, p.prepareSocket(), ErrSocketInUse, "socket in use removed")
+	assert.ErrorIs(t, p.Run(), ErrSocketInUse, "run with socket in use")
+
+	// 残留的 socket
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	assert.Nil(t, p.prepareSocket(), "prepare socket err")
+	_, err = os.Stat(p.socketFile)
+	assert.True(t, os.IsNotExist(err), "stale socket not removed")
+
+	// 不是 socket 的文件
+	assert.Nil(t, ioutil.WriteFile(p.socketFile, []byte("data"), 0644), "write file err")
+	assert.ErrorIs(t, p.prepareSocket(), ErrNotSocket, "regular file removed")
+}
+
+func TestChownSocket(t *testing.T) {
+	p := newTestProxy()
+	p.socketFile = filepath.Join(t.TempDir(), "umyproxy.socket")
+	p.SetSocketOption(SocketOption{Group: "group-not-exists", Mode: 0660})
+
+	l, err := net.Listen("unix", p.socketFile)
+	assert.Nil(t, err, "listen err")
+	defer l.Close()
+	assert.NotNil(t, p.chownSocket(), "unknown group")
+
+	p.SetSocketOption(SocketOption{Owner: "", Group: "", Mode: 0660})
+	assert.Nil(t, p.chownSocket(), "chown socket err")
+	fi, err := os.Stat(p.socketFile)
+	assert.Nil(t, err, "stat err")
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm(), "socket mode err")
+}
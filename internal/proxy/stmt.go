@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+
+	"github.com/lyuangg/umyproxy/protocol"
+)
+
+// 每个 mysql 连接默认缓存的预处理语句数
+const DefaultStmtCacheSize = 128
+
+type (
+	// mysql 连接上已经预处理的语句, 按 sql 复用, 超出数量时关闭最久没有使用的
+	stmtCache struct {
+		size  int
+		order *list.List
+		stmts map[string]*list.Element
+	}
+
+	cachedStmt struct {
+		query string
+		id    uint32
+		// 客户端预处理时返回的 OK 包和 parameter, column 定义
+		response []protocol.Packet
+	}
+
+	// transaction 模式下客户端使用的虚拟语句 id, 执行时在当前的 mysql 连接上按 sql 重新预处理
+	clientStmts struct {
+		nextId uint32
+		stmts  map[uint32]*clientStmt
+	}
+
+	clientStmt struct {
+		query  string
+		params int
+		// 有参数使用 COM_STMT_SEND_LONG_DATA 发送, 执行包中没有它的值
+		longData bool
+		// 上一次执行绑定的参数类型
+		types      []byte
+		typesCount int
+	}
+)
+
+func newStmtCache(size int) *stmtCache {
+	if size <= 0 {
+		size = DefaultStmtCacheSize
+	}
+	return &stmtCache{size: size, order: list.New(), stmts: make(map[string]*list.Element)}
+}
+
+func (c *stmtCache) Get(query string) *cachedStmt {
+	e, ok := c.stmts[query]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedStmt)
+}
+
+// 加入缓存, 返回需要在 mysql 连接上关闭的语句
+func (c *stmtCache) Add(stmt *cachedStmt) []*cachedStmt {
+	if e, ok := c.stmts[stmt.query]; ok {
+		c.order.Remove(e)
+	}
+	c.stmts[stmt.query] = c.order.PushFront(stmt)
+
+	evicted := make([]*cachedStmt, 0)
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		old := e.Value.(*cachedStmt)
+		delete(c.stmts, old.query)
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+// COM_RESET_CONNECTION 和 COM_CHANGE_USER 会释放连接上所有的语句
+func (c *stmtCache) Clear() {
+	c.order.Init()
+	c.stmts = make(map[string]*list.Element)
+}
+
+func newClientStmts() *clientStmts {
+	return &clientStmts{stmts: make(map[uint32]*clientStmt)}
+}
+
+func (s *clientStmts) Add(stmt *clientStmt) uint32 {
+	s.nextId++
+	s.stmts[s.nextId] = stmt
+	return s.nextId
+}
+
+// 虚拟化预处理语句 id, 返回需要发送给 mysql 的命令, 已经响应客户端时返回 false
+// 预处理的响应从连接的缓存读取, 执行等命令中的 id 替换为当前 mysql 连接上的语句 id
+func (p *Proxy) virtualStatement(client, server protocol.Connector, session *protocol.Session, stmts *clientStmts, cmd protocol.Packet) (protocol.Packet, bool, error) {
+	switch cmd.Command() {
+	case protocol.COM_STMT_PREPARE:
+		stmt, errPacket, err := p.prepare(server, session, string(cmd.Payload[1:]))
+		if err != nil {
+			return cmd, false, err
+		}
+		if errPacket != nil {
+			return cmd, false, client.WritePacket(*errPacket)
+		}
+
+		ok, err := session.ParsePrepareOk(stmt.response[0])
+		if err != nil {
+			return cmd, false, err
+		}
+		ok.StatementId = stmts.Add(&clientStmt{query: stmt.query, params: int(ok.Params)})
+		response := append([]protocol.Packet{{Payload: ok.Encode(session.Capability), SeqId: stmt.response[0].SeqId}}, stmt.response[1:]...)
+		for _, packet := range response {
+			if err := client.WritePacket(packet); err != nil {
+				return cmd, false, fmt.Errorf("write prepare response err: %w", err)
+			}
+		}
+		return cmd, false, nil
+
+	case protocol.COM_STMT_CLOSE:
+		// 语句留在连接的缓存中, 由其他客户端复用
+		if id, ok := protocol.StatementId(cmd); ok {
+			delete(stmts.stmts, id)
+		}
+		return cmd, false, nil
+
+	case protocol.COM_RESET_CONNECTION, protocol.COM_CHANGE_USER:
+		p.pool.statements(server).Clear()
+		stmts.stmts = make(map[uint32]*clientStmt)
+		return cmd, true, nil
+	}
+
+	id, ok := protocol.StatementId(cmd)
+	if !ok {
+		return cmd, true, nil
+	}
+	cs, ok := stmts.stmts[id]
+	if !ok {
+		return cmd, false, p.unknownStatement(client, cmd, id)
+	}
+
+	stmt, errPacket, err := p.prepare(server, session, cs.query)
+	if err != nil {
+		return cmd, false, err
+	}
+	if errPacket != nil {
+		if cmd.Command() == protocol.COM_STMT_SEND_LONG_DATA {
+			return cmd, false, nil
+		}
+		return cmd, false, client.WritePacket(*errPacket)
+	}
+
+	switch cmd.Command() {
+	case protocol.COM_STMT_SEND_LONG_DATA:
+		cs.longData = true
+	case protocol.COM_STMT_RESET:
+		cs.longData = false
+	case protocol.COM_STMT_EXECUTE:
+		types, count, err := session.ExecuteTypes(cmd, cs.params)
+		if err != nil {
+			return cmd, false, err
+		}
+		if types != nil {
+			cs.types, cs.typesCount = types, count
+		} else if cmd, err = session.BindExecuteTypes(cmd, cs.params, cs.types, cs.typesCount); err != nil {
+			return cmd, false, err
+		}
+		longData := cs.longData
+		cs.longData = false
+		if cmd, err = p.executeAttributes(session, cmd, cs.params, protocol.ConnCapability(server), longData); err != nil {
+			return cmd, false, err
+		}
+	}
+	return protocol.SetStatementId(cmd, stmt.id), true, nil
+}
+
+// 在 mysql 连接上预处理语句, 已经缓存时直接返回, 失败时返回需要发给客户端的 ERR 包
+func (p *Proxy) prepare(server protocol.Connector, session *protocol.Session, query string) (*cachedStmt, *protocol.Packet, error) {
+	cache := p.pool.statements(server)
+	if stmt := cache.Get(query); stmt != nil {
+		return stmt, nil, nil
+	}
+
+	err := server.WritePacket(protocol.Packet{Payload: append([]byte{protocol.COM_STMT_PREPARE}, query...)})
+	if err != nil {
+		return nil, nil, fmt.Errorf("send prepare err: %w", err)
+	}
+	result, err := server.ReadPacket()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read prepare result err: %w", err)
+	}
+	if protocol.IsErrPacket(result) {
+		return nil, &result, nil
+	}
+	ok, err := session.ParsePrepareOk(result)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stmt := &cachedStmt{query: query, id: ok.StatementId, response: []protocol.Packet{result}}
+	for i := session.PrepareDefinitions(ok); i > 0; i-- {
+		packet, err := server.ReadPacket()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read prepare definition err: %w", err)
+		}
+		stmt.response = append(stmt.response, packet)
+	}
+
+	for _, old := range cache.Add(stmt) {
+		if err := protocol.CloseStatement(server, old.id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return stmt, nil, nil
+}
+
+// 客户端使用了不存在的语句 id, COM_STMT_SEND_LONG_DATA 没有响应
+func (p *Proxy) unknownStatement(client protocol.Connector, cmd protocol.Packet, id uint32) error {
+	if cmd.Command() == protocol.COM_STMT_SEND_LONG_DATA {
+		return nil
+	}
+	msg := fmt.Sprintf("Unknown prepared statement handler (%d) given to %s", id, protocol.CommandName(cmd.Command()))
+	return client.WritePacket(protocol.NewErrPacket(protocol.ER_UNKNOWN_STMT_HANDLER, "HY000", msg, cmd.SeqId+1))
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lyuangg/umyproxy/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// statement_id, 0 column, 1 param, 之后是 parameter 定义和 EOF
+func testPrepareResponse(id byte) []protocol.Packet {
+	return []protocol.Packet{
+		{Payload: []byte{protocol.OK_PACKET, id, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}, SeqId: 1},
+		{Payload: []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, '?', 0, 0x0c, 0x3f, 0, 0, 0, 0, 0, 0x08, 0x80, 0, 0, 0}, SeqId: 2},
+		{Payload: []byte{protocol.EOF_PACKET, 0, 0, 2, 0}, SeqId: 3},
+	}
+}
+
+func TestVirtualStatement(t *testing.T) {
+	option := newOption(2)
+	option.Mode = PoolModeTransaction
+	option.StmtCacheSize = 1
+	p := NewProxy(NewPool(option), "")
+	session := &protocol.Session{Capability: protocol.CLIENT_PROTOCOL_41}
+	stmts := newClientStmts()
+	client := &MysqlTestConn{}
+
+	// 预处理返回虚拟 id
+	server1 := &MysqlTestConn{reads: testPrepareResponse(7)}
+	prepare := protocol.Packet{Payload: append([]byte{protocol.COM_STMT_PREPARE}, "SELECT ?"...)}
+	_, forward, err := p.virtualStatement(client, server1, session, stmts, prepare)
+	assert.Nil(t, err, "prepare err")
+	assert.False(t, forward, "prepare forwarded")
+	assert.Len(t, client.writes, 3, "prepare response err")
+	assert.Equal(t, []byte{1, 0, 0, 0}, client.writes[0].Payload[1:5], "virtual id err")
+
+	// 执行时替换为连接上的 id, 记录绑定的类型
+	execute := protocol.Packet{Payload: []byte{protocol.COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 1, 0, 0, 0, 0, 0, 0, 0}}
+	cmd, forward, err := p.virtualStatement(client, server1, session, stmts, execute)
+	assert.Nil(t, err, "execute err")
+	assert.True(t, forward, "execute not forwarded")
+	assert.Equal(t, []byte{7, 0, 0, 0}, cmd.Payload[1:5], "statement id err")
+	assert.Len(t, server1.writes, 1, "statement prepared again")
+
+	// 在另一个连接上执行时重新预处理, 补上参数类型
+	server2 := &MysqlTestConn{reads: testPrepareResponse(3)}
+	rebind := protocol.Packet{Payload: []byte{protocol.COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}}
+	cmd, forward, err = p.virtualStatement(client, server2, session, stmts, rebind)
+	assert.Nil(t, err, "execute err")
+	assert.True(t, forward, "execute not forwarded")
+	assert.Equal(t, protocol.COM_STMT_PREPARE, int(server2.writes[0].Payload[0]), "statement not prepared")
+	assert.Equal(t, []byte{protocol.COM_STMT_EXECUTE, 3, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 2, 0, 0, 0, 0, 0, 0, 0}, cmd.Payload, "execute types err")
+
+	// 缓存满时关闭最久没有使用的语句
+	server2.reads = testPrepareResponse(4)
+	prepare = protocol.Packet{Payload: append([]byte{protocol.COM_STMT_PREPARE}, "SELECT ? + 1"...)}
+	_, _, err = p.virtualStatement(client, server2, session, stmts, prepare)
+	assert.Nil(t, err, "prepare err")
+	assert.Equal(t, []byte{protocol.COM_STMT_CLOSE, 3, 0, 0, 0}, server2.writes[2].Payload, "statement not evicted")
+
+	// 关闭后不能再执行
+	client.writes = nil
+	_, forward, err = p.virtualStatement(client, server1, session, stmts, protocol.Packet{Payload: []byte{protocol.COM_STMT_CLOSE, 1, 0, 0, 0}})
+	assert.Nil(t, err, "close err")
+	assert.False(t, forward, "close forwarded")
+	_, forward, err = p.virtualStatement(client, server1, session, stmts, execute)
+	assert.Nil(t, err, "execute err")
+	assert.False(t, forward, "unknown statement forwarded")
+	assert.Equal(t, protocol.ER_UNKNOWN_STMT_HANDLER, protocol.ParseErrPacket(client.writes[0]).Code, "unknown statement err")
+}
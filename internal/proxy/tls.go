@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/lyuangg/umyproxy/protocol"
+)
+
+// 与 mysql 客户端 --ssl-mode 含义相同
+const (
+	SSLModeDisabled       = "disabled"
+	SSLModePreferred      = "preferred"
+	SSLModeRequired       = "required"
+	SSLModeVerifyCA       = "verify_ca"
+	SSLModeVerifyIdentity = "verify_identity"
+)
+
+type (
+	// 连接 mysql 服务端使用的 TLS 配置
+	TLSOption struct {
+		Mode string
+		// CA 证书文件, 为空时使用系统证书
+		CA string
+		// 客户端证书和私钥文件
+		Cert string
+		Key  string
+		// 校验证书使用的服务器名, 为空时使用 host
+		ServerName string
+	}
+)
+
+// 创建 tls.Config, disabled 时返回 nil
+func (o TLSOption) Config(host string) (*tls.Config, error) {
+	switch o.Mode {
+	case "", SSLModeDisabled:
+		return nil, nil
+	case SSLModePreferred, SSLModeRequired, SSLModeVerifyCA, SSLModeVerifyIdentity:
+	default:
+		return nil, fmt.Errorf("unknown ssl mode: %s", o.Mode)
+	}
+
+	config := &tls.Config{ServerName: o.ServerName, MinVersion: tls.VersionTLS12}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	if o.CA != "" {
+		data, err := ioutil.ReadFile(o.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read ssl ca err: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in ssl ca: %s", o.CA)
+		}
+	}
+
+	if o.Cert != "" || o.Key != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load ssl cert err: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch o.Mode {
+	case SSLModePreferred, SSLModeRequired:
+		config.InsecureSkipVerify = true
+	case SSLModeVerifyCA:
+		// 只校验证书链, 不校验服务器名
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyCA(config.RootCAs)
+	}
+	return config, nil
+}
+
+func verifyCA(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// 返回使用 TLS 连接 mysql 的 ConnCreater
+func NewTLSConnect(option TLSOption, host string) (ConnCreater, error) {
+	config, err := option.Config(host)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return NewConnect, nil
+	}
+
+	required := option.Mode != SSLModePreferred
+	return func(address string) (protocol.Connector, error) {
+		conn, err := net.DialTimeout("tcp", address, time.Second*2)
+		if err != nil {
+			return nil, fmt.Errorf("new tcp connect err: %w", err)
+		}
+		tcpconn := conn.(*net.TCPConn)
+		tcpconn.SetKeepAlive(true)
+		return protocol.NewTLSConn(tcpconn, config, required), nil
+	}, nil
+}
+
+// 客户端连接代理使用的 TLS 配置
+func NewServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls cert err: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// 代理登录 mysql 时默认使用的 capability
+const CLIENT_BASIC_FLAGS = CLIENT_LONG_PASSWORD | CLIENT_LONG_FLAG | CLIENT_PROTOCOL_41 | CLIENT_TRANSACTIONS |
+	CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH | CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA
+
+type (
+	// 代理自己登录 mysql 使用的账号
+	Account struct {
+		User       string
+		Password   []byte
+		Database   string
+		Charset    uint8
+		Capability uint32
+	}
+)
+
+// 使用代理的账号登录 mysql, 登录成功后的连接可以直接分配给客户端
+func (c *Conn) Connect(account Account) error {
+	hs, err := c.Handshake()
+	if err != nil {
+		return err
+	}
+
+	plugin := hs.AuthPlugin
+	if plugin != AUTH_CACHING_SHA2_PASSWORD {
+		plugin = AUTH_NATIVE_PASSWORD
+	}
+	scramble := hs.AuthData
+
+	resp := HandshakeResponse{
+		Capability:    (account.Capability | CLIENT_BASIC_FLAGS) & (hs.Capability | CLIENT_PROTOCOL_41),
+		MaxPacketSize: uint32(MAX_PAYLOAD_LEN),
+		Charset:       account.Charset,
+		User:          account.User,
+		AuthResponse:  ScramblePassword(plugin, scramble, account.Password),
+		Database:      account.Database,
+		AuthPlugin:    plugin,
+	}
+	if account.Database != "" {
+		resp.Capability |= CLIENT_CONNECT_WITH_DB
+	}
+	resp.Capability = c.compressCapability(hs, resp.Capability)
+
+	seqId := uint8(1)
+	upgraded, err := c.startTLS(hs, resp, seqId)
+	if err != nil {
+		return err
+	}
+	if upgraded {
+		resp.Capability |= CLIENT_SSL
+		seqId++
+	}
+
+	c.capability = resp.Capability
+	err = c.WritePacket(Packet{Payload: resp.Encode(), SeqId: seqId})
+	if err != nil {
+		return fmt.Errorf("send auth packet err: %w", err)
+	}
+
+	return c.authResult(account, plugin, scramble)
+}
+
+// 读取认证结果, 处理 AuthSwitchRequest 和 caching_sha2_password 的完整认证, 直到 OK 或 ERR
+func (c *Conn) authResult(account Account, plugin string, scramble []byte) error {
+	for {
+		result, err := c.ReadPacket()
+		if err != nil {
+			return fmt.Errorf("read auth result err: %w", err)
+		}
+		seqId := result.SeqId
+
+		var reply []byte
+		switch {
+		case IsOkPacket(result):
+			c.authSuccessPacket = result
+			c.authSuccess = true
+			c.startCompress()
+			return nil
+		case IsErrPacket(result):
+			return fmt.Errorf("%w: %v", ErrAuth, ParseErrPacket(result))
+		case IsAuthSwitchPacket(result):
+			plugin, scramble, err = ParseAuthSwitch(result.Payload)
+			if err != nil {
+				return fmt.Errorf("parse auth switch err: %w", err)
+			}
+			reply = ScramblePassword(plugin, scramble, account.Password)
+		case IsAuthMoreDataPacket(result) && result.Payload[1] == CACHING_SHA2_FAST_AUTH_SUCCESS:
+			continue
+		case IsAuthMoreDataPacket(result) && result.Payload[1] == CACHING_SHA2_FULL_AUTH:
+			if c.Secure() {
+				reply = append(append([]byte{}, account.Password...), 0)
+			} else if reply, seqId, err = c.encryptPassword(account.Password, scramble, seqId); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected auth packet: %w", ErrMalformedPacket)
+		}
+
+		seqId++
+		err = c.WritePacket(Packet{Payload: reply, SeqId: seqId})
+		if err != nil {
+			return fmt.Errorf("send auth data err: %w", err)
+		}
+	}
+}
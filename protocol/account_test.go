@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnect(t *testing.T) {
+	hs, err := ParseHandshake(testHandshakePayload)
+	assert.Nil(t, err, "parse handshake err")
+
+	ok := Packet{Payload: []byte{OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 2}
+	bconn := NewBufferConn(nil, packetBytes(Packet{Payload: testHandshakePayload}, ok))
+	c := NewConn(bconn)
+
+	account := Account{User: "proxy", Password: []byte("secret"), Database: "test", Charset: 45}
+	err = c.Connect(account)
+	assert.Nil(t, err, "connect err")
+
+	sent := readPackets(t, bconn.writeBuffer.Bytes())
+	assert.Len(t, sent, 1, "sent packets err")
+	resp, err := ParseHandshakeResponse(sent[0].Payload)
+	assert.Nil(t, err, "parse response err")
+	assert.Equal(t, "proxy", resp.User, "user err")
+	assert.Equal(t, "test", resp.Database, "database err")
+	assert.Equal(t, ScramblePassword(resp.AuthPlugin, hs.AuthData, account.Password), resp.AuthResponse, "auth response err")
+
+	// 认证成功后可以直接分配给客户端
+	login := testLogin(t)
+	login.Verified = true
+	client := NewBufferConn(nil, nil)
+	assert.Nil(t, c.Auth(NewConn(client), login), "fake auth err")
+}
+
+func TestConnectDenied(t *testing.T) {
+	denied := NewErrPacket(ER_ACCESS_DENIED_ERROR, "28000", "Access denied", 2)
+	bconn := NewBufferConn(nil, packetBytes(Packet{Payload: testHandshakePayload}, denied))
+	err := NewConn(bconn).Connect(Account{User: "proxy"})
+	assert.ErrorIs(t, err, ErrAuth, "connect err")
+}
+
+func TestReset(t *testing.T) {
+	ok := Packet{Payload: []byte{OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 1}
+	bconn := NewBufferConn(nil, packetBytes(ok, ok))
+	assert.Nil(t, NewConn(bconn).Reset("test"), "reset err")
+	sent := readPackets(t, bconn.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "sent packets err")
+	assert.Equal(t, []byte{COM_RESET_CONNECTION}, sent[0].Payload, "reset packet err")
+	assert.Equal(t, append([]byte{COM_INIT_DB}, "test"...), sent[1].Payload, "init db packet err")
+
+	unknown := NewErrPacket(ER_UNKNOWN_COM_ERROR, "08S01", "Unknown command", 1)
+	err := NewConn(NewBufferConn(nil, packetBytes(unknown))).Reset("")
+	var sqlErr *SQLError
+	assert.ErrorAs(t, err, &sqlErr, "reset err")
+	assert.Equal(t, ER_UNKNOWN_COM_ERROR, sqlErr.Code, "reset err code")
+}
+
+func TestCurrentDatabase(t *testing.T) {
+	column := ColumnDefinition{Catalog: "def", Name: "DATABASE()", Type: MYSQL_TYPE_VAR_STRING}
+	eof := []byte{EOF_PACKET, 0, 0, 2, 0}
+	result := func(row []byte) []byte {
+		return packetBytes(
+			Packet{Payload: []byte{1}, SeqId: 1},
+			Packet{Payload: column.Encode(), SeqId: 2},
+			Packet{Payload: eof, SeqId: 3},
+			Packet{Payload: row, SeqId: 4},
+			Packet{Payload: eof, SeqId: 5},
+		)
+	}
+
+	bconn := NewBufferConn(nil, result([]byte{NULL_VALUE}))
+	database, err := CurrentDatabase(NewConn(bconn))
+	assert.Nil(t, err, "query database err")
+	assert.Empty(t, database, "database err")
+	sent := readPackets(t, bconn.writeBuffer.Bytes())
+	assert.Len(t, sent, 1, "sent packets err")
+	assert.Equal(t, append([]byte{COM_QUERY}, "SELECT DATABASE()"...), sent[0].Payload, "query packet err")
+
+	database, err = CurrentDatabase(NewConn(NewBufferConn(nil, result(AppendLenEncString(nil, []byte("test"))))))
+	assert.Nil(t, err, "query database err")
+	assert.Equal(t, "test", database, "database err")
+}
+
+func TestChangeUser(t *testing.T) {
+	hs, err := ParseHandshake(testHandshakePayload)
+	assert.Nil(t, err, "parse handshake err")
+
+	ok := Packet{Payload: []byte{OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 1}
+	bconn := NewBufferConn(nil, packetBytes(Packet{Payload: testHandshakePayload}, ok))
+	c := NewConn(bconn)
+	_, err = c.Handshake()
+	assert.Nil(t, err, "handshake err")
+
+	account := Account{User: "proxy", Password: []byte("secret"), Database: "test", Charset: 45}
+	assert.Nil(t, c.ChangeUser(account), "change user err")
+
+	sent := readPackets(t, bconn.writeBuffer.Bytes())
+	assert.Len(t, sent, 1, "sent packets err")
+	assert.Equal(t, uint8(0), sent[0].SeqId, "change user seq err")
+
+	authResponse := ScramblePassword(AUTH_NATIVE_PASSWORD, hs.AuthData, account.Password)
+	expected := append([]byte{COM_CHANGE_USER}, "proxy\x00"...)
+	expected = append(append(append(expected, byte(len(authResponse))), authResponse...), "test\x00"...)
+	expected = append(append(expected, 45, 0), AUTH_NATIVE_PASSWORD+"\x00"...)
+	assert.Equal(t, expected, sent[0].Payload, "change user packet err")
+}
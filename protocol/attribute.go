@@ -0,0 +1,297 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// 参数类型第二个字节中的无符号标志
+const PARAMETER_FLAG_UNSIGNED byte = 0x80
+
+type (
+	// CLIENT_QUERY_ATTRIBUTES 时随 COM_QUERY 和 COM_STMT_EXECUTE 发送的 query attribute
+	// 值与二进制协议相同, 字符串不包括长度前缀, NULL 为 nil
+	QueryAttribute struct {
+		Name     string
+		Type     byte
+		Unsigned bool
+		Value    []byte
+	}
+
+	QueryAttributes []QueryAttribute
+
+	// COM_QUERY 的 sql 和 query attributes
+	Query struct {
+		Attributes QueryAttributes
+		Query      string
+	}
+)
+
+// 字符串类型的 attribute
+func StringAttribute(name, value string) QueryAttribute {
+	return QueryAttribute{Name: name, Type: MYSQL_TYPE_STRING, Value: []byte(value)}
+}
+
+// 值的文本形式, 整数和浮点数按类型解码, NULL 为空字符串, 其他类型返回原始内容
+func (a QueryAttribute) Text() string {
+	v := a.Value
+	switch {
+	case a.Type == MYSQL_TYPE_TINY && len(v) == 1:
+		if a.Unsigned {
+			return strconv.FormatUint(uint64(v[0]), 10)
+		}
+		return strconv.FormatInt(int64(int8(v[0])), 10)
+	case (a.Type == MYSQL_TYPE_SHORT || a.Type == MYSQL_TYPE_YEAR) && len(v) == 2:
+		if a.Unsigned {
+			return strconv.FormatUint(uint64(binary.LittleEndian.Uint16(v)), 10)
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(v))), 10)
+	case (a.Type == MYSQL_TYPE_LONG || a.Type == MYSQL_TYPE_INT24) && len(v) == 4:
+		if a.Unsigned {
+			return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(v)), 10)
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(v))), 10)
+	case a.Type == MYSQL_TYPE_LONGLONG && len(v) == 8:
+		if a.Unsigned {
+			return strconv.FormatUint(binary.LittleEndian.Uint64(v), 10)
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(v)), 10)
+	case a.Type == MYSQL_TYPE_FLOAT && len(v) == 4:
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(v))), 'g', -1, 32)
+	case a.Type == MYSQL_TYPE_DOUBLE && len(v) == 8:
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(v)), 'g', -1, 64)
+	}
+	return string(v)
+}
+
+func (attrs QueryAttributes) Get(name string) (QueryAttribute, bool) {
+	for _, a := range attrs {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return QueryAttribute{}, false
+}
+
+// 替换同名的 attribute, 没有时加在最后
+func (attrs QueryAttributes) Set(attr QueryAttribute) QueryAttributes {
+	for i, a := range attrs {
+		if a.Name == attr.Name {
+			result := append(QueryAttributes{}, attrs...)
+			result[i] = attr
+			return result
+		}
+	}
+	return append(attrs[:len(attrs):len(attrs)], attr)
+}
+
+// 解析 COM_QUERY, 协商了 CLIENT_QUERY_ATTRIBUTES 时 sql 前面是 query attributes
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query.html
+func (s *Session) ParseQuery(cmd Packet) (Query, error) {
+	if cmd.Command() != COM_QUERY {
+		return Query{}, fmt.Errorf("parse query err: %w", ErrMalformedPacket)
+	}
+	if s.Capability&CLIENT_QUERY_ATTRIBUTES == 0 {
+		return Query{Query: string(cmd.Payload[1:])}, nil
+	}
+
+	r := reader{data: cmd.Payload, pos: 1}
+	count := r.lenEncInt()
+	// parameter_set_count, 总是 1
+	r.lenEncInt()
+	q := Query{}
+	if count > 0 && r.err == nil {
+		attrs, bound := readAttributes(&r, count, true)
+		if !bound && r.err == nil {
+			r.err = ErrMalformedPacket
+		}
+		q.Attributes = attrs
+	}
+	if r.err != nil {
+		return Query{}, fmt.Errorf("parse query attributes err: %w", r.err)
+	}
+	q.Query = string(r.data[r.pos:])
+	return q, nil
+}
+
+// COM_QUERY 的 payload, capability 没有 CLIENT_QUERY_ATTRIBUTES 时不发送 attributes
+func (q Query) Encode(capability uint32) []byte {
+	b := []byte{COM_QUERY}
+	if capability&CLIENT_QUERY_ATTRIBUTES != 0 {
+		b = AppendLenEncInt(b, uint64(len(q.Attributes)))
+		b = AppendLenEncInt(b, 1)
+		if len(q.Attributes) > 0 {
+			b = appendAttributes(b, q.Attributes)
+		}
+	}
+	return append(b, q.Query...)
+}
+
+// COM_STMT_EXECUTE 中语句参数之后的 query attributes, params 是语句的参数个数
+// 没有绑定参数类型 (new_params_bound_flag 为 0) 时没有 attribute 的名字, 返回 nil
+// 参数使用 COM_STMT_SEND_LONG_DATA 发送时执行包中没有它的值, 不能解析
+func (s *Session) ExecuteAttributes(cmd Packet, params int) (QueryAttributes, error) {
+	if s.Capability&CLIENT_QUERY_ATTRIBUTES == 0 {
+		return nil, nil
+	}
+	values, bound, err := s.executeValues(cmd, params)
+	if err != nil || !bound || len(values) <= params {
+		return nil, err
+	}
+	return values[params:], nil
+}
+
+// 把 COM_STMT_EXECUTE 的 query attributes 替换为 attrs, 按 capability 的格式编码
+// 没有绑定参数类型时不能加上 attribute, 只转换格式; 和 ExecuteAttributes 一样不能用于有 COM_STMT_SEND_LONG_DATA 参数的执行包
+func (s *Session) SetExecuteAttributes(cmd Packet, params int, attrs QueryAttributes, capability uint32) (Packet, error) {
+	if capability&CLIENT_QUERY_ATTRIBUTES == 0 {
+		return cmd, nil
+	}
+	values, bound, err := s.executeValues(cmd, params)
+	if err != nil {
+		return cmd, fmt.Errorf("set execute attributes err: %w", err)
+	}
+	if !bound {
+		return s.ConvertExecute(cmd, params, capability)
+	}
+	if len(values) < params {
+		return cmd, fmt.Errorf("set execute attributes err: %w", ErrMalformedPacket)
+	}
+
+	values = append(values[:params:params], attrs...)
+	payload := make([]byte, 0, len(cmd.Payload)+64)
+	payload = append(payload, cmd.Payload[:10]...)
+	if params == 0 {
+		payload[5] |= PARAMETER_COUNT_AVAILABLE
+	}
+	payload = AppendLenEncInt(payload, uint64(len(values)))
+	if len(values) > 0 {
+		payload = appendAttributes(payload, values)
+	}
+	return Packet{Payload: payload, SeqId: cmd.SeqId}, nil
+}
+
+// COM_STMT_EXECUTE 绑定的参数值和 query attributes, 参数的名字为空
+// 没有绑定参数类型时不能读取值, 返回 false
+func (s *Session) executeValues(cmd Packet, params int) (QueryAttributes, bool, error) {
+	if len(cmd.Payload) < 10 {
+		return nil, false, fmt.Errorf("parse execute err: %w", ErrMalformedPacket)
+	}
+	pos, count, err := s.executeParams(cmd, params)
+	if err != nil || count == 0 {
+		return nil, err == nil, err
+	}
+
+	r := reader{data: cmd.Payload, pos: pos - (count+7)/8}
+	values, bound := readAttributes(&r, uint64(count), s.Capability&CLIENT_QUERY_ATTRIBUTES != 0)
+	if r.err == nil && bound && !r.eof() {
+		r.err = ErrMalformedPacket
+	}
+	if r.err != nil {
+		return nil, false, fmt.Errorf("parse execute values err: %w", r.err)
+	}
+	return values, bound, nil
+}
+
+// 把没有协商 CLIENT_QUERY_ATTRIBUTES 的客户端的 COM_STMT_EXECUTE 转换为 capability 的格式
+// 有参数时加上参数个数, 绑定的每个参数类型后面加上空的名字; params 是语句的参数个数
+func (s *Session) ConvertExecute(cmd Packet, params int, capability uint32) (Packet, error) {
+	if s.Capability&CLIENT_QUERY_ATTRIBUTES != 0 || capability&CLIENT_QUERY_ATTRIBUTES == 0 || params == 0 {
+		return cmd, nil
+	}
+	pos, count, err := s.executeParams(cmd, params)
+	if err != nil {
+		return cmd, fmt.Errorf("convert execute err: %w", err)
+	}
+
+	header := pos - (count+7)/8
+	payload := make([]byte, 0, len(cmd.Payload)+9+count)
+	payload = append(payload, cmd.Payload[:header]...)
+	payload = AppendLenEncInt(payload, uint64(count))
+	payload = append(payload, cmd.Payload[header:pos+1]...)
+	values := pos + 1
+	if cmd.Payload[pos] == 1 {
+		values += count * 2
+		if values > len(cmd.Payload) {
+			return cmd, fmt.Errorf("convert execute err: %w", ErrMalformedPacket)
+		}
+		for i := pos + 1; i < values; i += 2 {
+			payload = append(payload, cmd.Payload[i], cmd.Payload[i+1], 0)
+		}
+	}
+	payload = append(payload, cmd.Payload[values:]...)
+	return Packet{Payload: payload, SeqId: cmd.SeqId}, nil
+}
+
+// 读取 NULL bitmap, new_params_bind_flag, 参数类型和名字, 参数值; names 为 false 时类型后面没有名字
+// new_params_bind_flag 为 0 时没有类型, 不能读取值, 返回 false
+func readAttributes(r *reader, count uint64, names bool) (QueryAttributes, bool) {
+	if count > uint64(len(r.data)) {
+		r.err = ErrMalformedPacket
+		return nil, false
+	}
+	bitmap := r.bytes(int((count + 7) / 8))
+	if r.byte() != 1 || r.err != nil {
+		return nil, false
+	}
+
+	attrs := make(QueryAttributes, count)
+	for i := range attrs {
+		if t := r.bytes(2); t != nil {
+			attrs[i].Type = t[0]
+			attrs[i].Unsigned = t[1]&PARAMETER_FLAG_UNSIGNED != 0
+		}
+		if names {
+			attrs[i].Name = string(r.lenEncBytes())
+		}
+	}
+	for i := range attrs {
+		if r.err != nil {
+			break
+		}
+		if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+		switch n := binaryValueLength(attrs[i].Type); n {
+		case binaryLenEncValue:
+			attrs[i].Value = append([]byte{}, r.lenEncBytes()...)
+		case binaryShortValue:
+			attrs[i].Value = append([]byte{}, r.bytes(int(r.byte()))...)
+		default:
+			attrs[i].Value = append([]byte{}, r.bytes(n)...)
+		}
+	}
+	return attrs, true
+}
+
+func appendAttributes(b []byte, attrs QueryAttributes) []byte {
+	bitmap := make([]byte, (len(attrs)+7)/8)
+	types := make([]byte, 0, 64)
+	values := make([]byte, 0, 64)
+	for i, a := range attrs {
+		flag := byte(0)
+		if a.Unsigned {
+			flag = PARAMETER_FLAG_UNSIGNED
+		}
+		types = AppendLenEncString(append(types, a.Type, flag), []byte(a.Name))
+
+		if a.Value == nil {
+			bitmap[i/8] |= 1 << uint(i%8)
+			continue
+		}
+		switch binaryValueLength(a.Type) {
+		case binaryLenEncValue:
+			values = AppendLenEncString(values, a.Value)
+		case binaryShortValue:
+			values = append(append(values, byte(len(a.Value))), a.Value...)
+		default:
+			values = append(values, a.Value...)
+		}
+	}
+	b = append(b, bitmap...)
+	b = append(b, 1)
+	b = append(b, types...)
+	return append(b, values...)
+}
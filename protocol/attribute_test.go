@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryAttributes(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_QUERY_ATTRIBUTES}
+
+	// 2 个 attribute: trace_id 字符串, retry 无符号 TINY, 之后是 sql
+	cmd := Packet{Payload: []byte{COM_QUERY, 2, 1, 0, 1,
+		MYSQL_TYPE_STRING, 0, 8, 't', 'r', 'a', 'c', 'e', '_', 'i', 'd',
+		MYSQL_TYPE_TINY, PARAMETER_FLAG_UNSIGNED, 5, 'r', 'e', 't', 'r', 'y',
+		3, 'a', 'b', 'c', 200,
+		'S', 'E', 'L', 'E', 'C', 'T', ' ', '1'}}
+	q, err := session.ParseQuery(cmd)
+	assert.Nil(t, err, "parse query err")
+	assert.Equal(t, "SELECT 1", q.Query, "query err")
+	assert.Len(t, q.Attributes, 2, "attributes err")
+	traceId, ok := q.Attributes.Get("trace_id")
+	assert.True(t, ok, "trace_id not found")
+	assert.Equal(t, "abc", traceId.Text(), "trace_id err")
+	retry, _ := q.Attributes.Get("retry")
+	assert.Equal(t, "200", retry.Text(), "unsigned attribute err")
+	assert.Equal(t, cmd.Payload, q.Encode(session.Capability), "encode query err")
+
+	// 同名替换, 不修改原来的 attributes
+	attrs := q.Attributes.Set(StringAttribute("trace_id", "xyz")).Set(QueryAttribute{Name: "empty", Type: MYSQL_TYPE_NULL})
+	assert.Len(t, attrs, 3, "set attributes err")
+	traceId, _ = q.Attributes.Get("trace_id")
+	assert.Equal(t, "abc", traceId.Text(), "original attributes changed")
+
+	q2, err := session.ParseQuery(Packet{Payload: Query{Attributes: attrs, Query: "SELECT 2"}.Encode(session.Capability)})
+	assert.Nil(t, err, "parse encoded query err")
+	assert.Equal(t, Query{Attributes: attrs, Query: "SELECT 2"}, q2, "query round trip err")
+
+	// 没有 attribute 时只有 parameter_count 和 parameter_set_count
+	assert.Equal(t, []byte{COM_QUERY, 0, 1, 'x'}, Query{Query: "x"}.Encode(session.Capability), "empty attributes err")
+	_, err = session.ParseQuery(Packet{Payload: []byte{COM_QUERY, 0xfd, 0xff, 0xff, 0xff, 1, 0}})
+	assert.NotNil(t, err, "malformed attributes parsed")
+
+	// 没有协商 CLIENT_QUERY_ATTRIBUTES 时 payload 只有 sql
+	plain := &Session{Capability: CLIENT_PROTOCOL_41}
+	q, err = plain.ParseQuery(Packet{Payload: []byte{COM_QUERY, 'x'}})
+	assert.Nil(t, err, "parse plain query err")
+	assert.Equal(t, Query{Query: "x"}, q, "plain query err")
+	assert.Equal(t, []byte{COM_QUERY, 'x'}, Query{Attributes: attrs, Query: "x"}.Encode(plain.Capability), "attributes sent without capability")
+}
+
+func TestExecuteAttributes(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_QUERY_ATTRIBUTES}
+
+	// 1 个语句参数 LONGLONG, 1 个 attribute "n" = "v"
+	cmd := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 1,
+		MYSQL_TYPE_LONGLONG, 0, 0, MYSQL_TYPE_VAR_STRING, 0, 1, 'n',
+		7, 0, 0, 0, 0, 0, 0, 0, 1, 'v'}}
+	attrs, err := session.ExecuteAttributes(cmd, 1)
+	assert.Nil(t, err, "parse execute attributes err")
+	assert.Equal(t, QueryAttributes{{Name: "n", Type: MYSQL_TYPE_VAR_STRING, Value: []byte("v")}}, attrs, "execute attributes err")
+
+	// 只有语句参数
+	attrs, err = session.ExecuteAttributes(Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 1, MYSQL_TYPE_TINY, 0, 0, 7}}, 1)
+	assert.Nil(t, err, "parse execute err")
+	assert.Empty(t, attrs, "execute attributes err")
+}
+
+// 没有协商 CLIENT_QUERY_ATTRIBUTES 的客户端的执行包转换为 mysql 连接的格式
+func TestConvertExecute(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+	capability := uint32(CLIENT_PROTOCOL_41 | CLIENT_QUERY_ATTRIBUTES)
+
+	// 2 个参数: LONGLONG 7 和 NULL
+	cmd := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0x02, 1,
+		MYSQL_TYPE_LONGLONG, 0, MYSQL_TYPE_NULL, 0,
+		7, 0, 0, 0, 0, 0, 0, 0}, SeqId: 0}
+	converted, err := session.ConvertExecute(cmd, 2, capability)
+	assert.Nil(t, err, "convert execute err")
+	assert.Equal(t, []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0x02, 1,
+		MYSQL_TYPE_LONGLONG, 0, 0, MYSQL_TYPE_NULL, 0, 0,
+		7, 0, 0, 0, 0, 0, 0, 0}, converted.Payload, "converted execute err")
+
+	attrSession := &Session{Capability: capability}
+	attrs, err := attrSession.ExecuteAttributes(converted, 2)
+	assert.Nil(t, err, "parse converted execute err")
+	assert.Empty(t, attrs, "converted execute attributes err")
+
+	// 没有绑定类型时只加参数个数
+	unbound := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0}}
+	converted, err = session.ConvertExecute(unbound, 1, capability)
+	assert.Nil(t, err, "convert execute err")
+	assert.Equal(t, []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0}, converted.Payload, "unbound execute err")
+
+	// 没有参数或 mysql 连接没有协商时不变
+	noParams := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0}}
+	converted, err = session.ConvertExecute(noParams, 0, capability)
+	assert.Nil(t, err, "convert execute err")
+	assert.Equal(t, noParams, converted, "execute without params changed")
+	converted, err = session.ConvertExecute(cmd, 2, CLIENT_PROTOCOL_41)
+	assert.Nil(t, err, "convert execute err")
+	assert.Equal(t, cmd, converted, "execute changed")
+}
+
+func TestSetExecuteAttributes(t *testing.T) {
+	capability := uint32(CLIENT_PROTOCOL_41 | CLIENT_QUERY_ATTRIBUTES)
+	attrSession := &Session{Capability: capability}
+	app := StringAttribute("app", "web")
+
+	// 替换客户端的 attributes, 语句参数不变
+	cmd := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 1,
+		MYSQL_TYPE_LONGLONG, 0, 0, MYSQL_TYPE_VAR_STRING, 0, 1, 'n',
+		7, 0, 0, 0, 0, 0, 0, 0, 1, 'v'}, SeqId: 0}
+	attrs, err := attrSession.ExecuteAttributes(cmd, 1)
+	assert.Nil(t, err, "parse execute attributes err")
+	set, err := attrSession.SetExecuteAttributes(cmd, 1, attrs.Set(app), capability)
+	assert.Nil(t, err, "set execute attributes err")
+	assert.Equal(t, []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 3, 0, 1,
+		MYSQL_TYPE_LONGLONG, 0, 0, MYSQL_TYPE_VAR_STRING, 0, 1, 'n', MYSQL_TYPE_STRING, 0, 3, 'a', 'p', 'p',
+		7, 0, 0, 0, 0, 0, 0, 0, 1, 'v', 3, 'w', 'e', 'b'}, set.Payload, "execute attributes err")
+
+	// 没有协商的客户端, 没有参数的语句
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+	noParams := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0}}
+	set, err = session.SetExecuteAttributes(noParams, 0, QueryAttributes{app}, capability)
+	assert.Nil(t, err, "set execute attributes err")
+	attrs, err = attrSession.ExecuteAttributes(set, 0)
+	assert.Nil(t, err, "parse execute attributes err")
+	assert.Equal(t, QueryAttributes{app}, attrs, "execute attributes err")
+
+	// 没有绑定类型时只转换格式
+	unbound := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0}}
+	set, err = session.SetExecuteAttributes(unbound, 1, QueryAttributes{app}, capability)
+	assert.Nil(t, err, "set execute attributes err")
+	converted, _ := session.ConvertExecute(unbound, 1, capability)
+	assert.Equal(t, converted, set, "unbound execute err")
+}
@@ -0,0 +1,253 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash"
+)
+
+const (
+	ER_CON_COUNT_ERROR     uint16 = 1040
+	ER_ACCESS_DENIED_ERROR uint16 = 1045
+	ER_HOST_NOT_PRIVILEGED uint16 = 1130
+
+	AUTH_NATIVE_PASSWORD       = "mysql_native_password"
+	AUTH_CACHING_SHA2_PASSWORD = "caching_sha2_password"
+
+	AUTH_MORE_DATA_PACKET byte = 0x01
+
+	// caching_sha2_password AuthMoreData
+	CACHING_SHA2_REQUEST_PUBLIC_KEY byte = 0x02
+	CACHING_SHA2_FAST_AUTH_SUCCESS  byte = 0x03
+	CACHING_SHA2_FULL_AUTH          byte = 0x04
+
+	SCRAMBLE_LENGTH = 20
+)
+
+type (
+	// 已知密码的用户保存的 stage2 hash, 用于校验之后的登录
+	// 只保存 hash, 每次登录使用新的 scramble 校验, 记录的 auth-response 不能重放
+	Credential struct {
+		NativeStage2 []byte
+		Sha2Stage2   []byte
+	}
+)
+
+// 记录登录成功的认证数据, 只有得到明文密码时才能校验之后的登录
+// mysql_native_password 的 auth-response 推导不出 stage2 hash, 需要在用户列表中配置
+func NewCredential(login *Login) Credential {
+	cred := Credential{}
+	if login.Password != nil {
+		cred.SetPassword(login.Password)
+	}
+	return cred
+}
+
+// 保存密码的 stage2 hash: SHA1(SHA1(password)) 和 SHA256(SHA256(password))
+func (cred *Credential) SetPassword(password []byte) {
+	if len(password) == 0 {
+		cred.NativeStage2 = []byte{}
+		cred.Sha2Stage2 = []byte{}
+		return
+	}
+	cred.NativeStage2 = nativeScrambler.stage2(password)
+	cred.Sha2Stage2 = sha2Scrambler.stage2(password)
+}
+
+func (cred Credential) KnownPassword() bool {
+	return cred.NativeStage2 != nil
+}
+
+// 校验客户端使用当前 scramble 计算的 auth-response, 不知道密码时不能校验, 返回 false
+func (cred Credential) Verify(client Connector, login *Login) (bool, error) {
+	if !cred.KnownPassword() {
+		return false, nil
+	}
+	return cred.verifyStage2(client, login)
+}
+
+// 使用 stage2 hash 校验客户端用当前 scramble 计算的 auth-response
+func (cred Credential) verifyStage2(client Connector, login *Login) (bool, error) {
+	plugin := login.Response.AuthPlugin
+	// 只知道 mysql_native_password 的 hash 时切换插件
+	if plugin == AUTH_CACHING_SHA2_PASSWORD && cred.Sha2Stage2 == nil {
+		plugin = ""
+	}
+	if plugin != AUTH_NATIVE_PASSWORD && plugin != AUTH_CACHING_SHA2_PASSWORD {
+		if err := SwitchAuth(client, login, AUTH_NATIVE_PASSWORD, login.Scramble); err != nil {
+			return false, err
+		}
+		plugin = AUTH_NATIVE_PASSWORD
+	}
+
+	response := login.Response.AuthResponse
+	switch plugin {
+	case AUTH_NATIVE_PASSWORD:
+		login.Verified = nativeScrambler.check(login.Scramble, response, cred.NativeStage2)
+	case AUTH_CACHING_SHA2_PASSWORD:
+		login.Verified = sha2Scrambler.check(login.Scramble, response, cred.Sha2Stage2)
+	}
+	return login.Verified, nil
+}
+
+// 发送 AuthSwitchRequest, 客户端使用新的 plugin 和 scramble 重新计算 auth-response
+func SwitchAuth(client Connector, login *Login, plugin string, scramble []byte) error {
+	if login.Response.Capability&CLIENT_PLUGIN_AUTH == 0 {
+		return ErrAuthSwitch
+	}
+
+	err := client.WritePacket(AuthSwitchPacket(plugin, scramble, login.Packet.SeqId+1))
+	if err != nil {
+		return fmt.Errorf("send auth switch err: %w", err)
+	}
+
+	switchResp, err := client.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("read auth switch response err: %w", err)
+	}
+
+	login.Response.AuthResponse = switchResp.Payload
+	login.Response.AuthPlugin = plugin
+	login.Scramble = scramble
+	login.Packet = Packet{Payload: login.Response.Encode(), SeqId: switchResp.SeqId}
+
+	return nil
+}
+
+// 拒绝登录的错误包
+func AccessDeniedPacket(login *Login, seqId uint8) Packet {
+	usingPassword := "NO"
+	if len(login.Response.AuthResponse) > 0 {
+		usingPassword = "YES"
+	}
+	msg := fmt.Sprintf("Access denied for user '%s'@'localhost' (using password: %s)", login.Response.User, usingPassword)
+	return NewErrPacket(ER_ACCESS_DENIED_ERROR, "28000", msg, seqId)
+}
+
+// 使用服务端 RSA 公钥加密密码: RSA_OAEP(XOR(password + "\0", scramble))
+func EncryptPassword(password, scramble, pemKey []byte) ([]byte, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, fmt.Errorf("decode public key err: %w", ErrMalformedPacket)
+	}
+
+	var pub *rsa.PublicKey
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is not rsa: %w", ErrMalformedPacket)
+		}
+		pub = rsaKey
+	} else if pub, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("parse public key err: %w", err)
+	}
+
+	plain := append(append([]byte{}, password...), 0)
+	if len(scramble) > 0 {
+		for i := range plain {
+			plain[i] ^= scramble[i%len(scramble)]
+		}
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+// 生成 20 字节的 scramble, 不包含 0 和 '$'
+func NewScramble() ([]byte, error) {
+	scramble := make([]byte, SCRAMBLE_LENGTH)
+	if _, err := rand.Read(scramble); err != nil {
+		return nil, err
+	}
+	for i, b := range scramble {
+		b &= 0x7f
+		if b == 0 || b == '$' {
+			b++
+		}
+		scramble[i] = b
+	}
+	return scramble, nil
+}
+
+// 按认证插件计算 auth-response
+func ScramblePassword(plugin string, scramble, password []byte) []byte {
+	if len(password) == 0 {
+		return []byte{}
+	}
+	return scramblerOf(plugin).scramble(scramble, password)
+}
+
+type scrambler struct {
+	newHash func() hash.Hash
+	// caching_sha2_password 先写 stage2 再写 scramble
+	stage2First bool
+}
+
+var (
+	// XOR(SHA1(password), SHA1(scramble, SHA1(SHA1(password))))
+	nativeScrambler = scrambler{newHash: sha1.New}
+	// XOR(SHA256(password), SHA256(SHA256(SHA256(password)), scramble))
+	sha2Scrambler = scrambler{newHash: sha256.New, stage2First: true}
+)
+
+func scramblerOf(plugin string) scrambler {
+	if plugin == AUTH_CACHING_SHA2_PASSWORD {
+		return sha2Scrambler
+	}
+	return nativeScrambler
+}
+
+func (s scrambler) sum(data []byte) []byte {
+	h := s.newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func (s scrambler) stage2(password []byte) []byte {
+	return s.sum(s.sum(password))
+}
+
+func (s scrambler) salt(scramble, stage2 []byte) []byte {
+	if len(scramble) > SCRAMBLE_LENGTH {
+		scramble = scramble[:SCRAMBLE_LENGTH]
+	}
+	h := s.newHash()
+	if s.stage2First {
+		h.Write(stage2)
+		h.Write(scramble)
+	} else {
+		h.Write(scramble)
+		h.Write(stage2)
+	}
+	return h.Sum(nil)
+}
+
+func (s scrambler) scramble(scramble, password []byte) []byte {
+	stage1 := s.sum(password)
+	return xorBytes(stage1, s.salt(scramble, s.sum(stage1)))
+}
+
+// 还原 stage1 后比较 hash(stage1) 与 stage2
+func (s scrambler) check(scramble, response, stage2 []byte) bool {
+	if len(stage2) == 0 || len(response) == 0 {
+		return len(stage2) == 0 && len(response) == 0
+	}
+	h := s.salt(scramble, stage2)
+	if len(response) != len(h) {
+		return false
+	}
+	stage1 := xorBytes(response, h)
+	return bytes.Equal(s.sum(stage1), stage2)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
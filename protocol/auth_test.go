@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLogin(t *testing.T) *Login {
+	hs, err := ParseHandshake(testHandshakePayload)
+	assert.Nil(t, err, "parse handshake err")
+	resp, err := ParseHandshakeResponse(testAuthPayload)
+	assert.Nil(t, err, "parse auth err")
+	return &Login{Packet: Packet{Payload: testAuthPayload, SeqId: 1}, Response: resp, Scramble: hs.AuthData}
+}
+
+// 不知道密码时不校验, 不会让客户端切换到记录的 scramble
+func TestCredentialVerifyUnknownPassword(t *testing.T) {
+	cred := NewCredential(testLogin(t))
+	assert.False(t, cred.KnownPassword(), "password known")
+
+	bconn := NewBufferConn(nil, nil)
+	ok, err := cred.Verify(NewConn(bconn), testLogin(t))
+	assert.Nil(t, err, "verify err")
+	assert.False(t, ok, "verified without password")
+	assert.Zero(t, bconn.writeBuffer.Len(), "packet sent to client")
+}
+
+// 之前的 scramble 计算的 auth-response 不能在新的登录中重放
+func TestCredentialVerifyReplay(t *testing.T) {
+	login := testLogin(t)
+	login.Password = []byte("secret")
+	cred := NewCredential(login)
+
+	previous, err := NewScramble()
+	assert.Nil(t, err, "new scramble err")
+	replayed := ScramblePassword(AUTH_NATIVE_PASSWORD, previous, []byte("secret"))
+
+	scramble, err := NewScramble()
+	assert.Nil(t, err, "new scramble err")
+	replay := testLogin(t)
+	replay.Scramble = scramble
+	replay.Response.AuthPlugin = AUTH_NATIVE_PASSWORD
+	replay.Response.AuthResponse = replayed
+
+	bconn := NewBufferConn(nil, nil)
+	ok, err := cred.Verify(NewConn(bconn), replay)
+	assert.Nil(t, err, "verify err")
+	assert.False(t, ok, "replayed response verified")
+	assert.False(t, replay.Verified, "login verified")
+	assert.Zero(t, bconn.writeBuffer.Len(), "scramble switched")
+}
+
+func TestCredentialVerifyStage2(t *testing.T) {
+	cred := Credential{}
+	cred.SetPassword([]byte("secret"))
+	assert.True(t, cred.KnownPassword(), "password unknown")
+
+	for _, plugin := range []string{AUTH_NATIVE_PASSWORD, AUTH_CACHING_SHA2_PASSWORD} {
+		scramble, err := NewScramble()
+		assert.Nil(t, err, "new scramble err")
+
+		login := testLogin(t)
+		login.Scramble = scramble
+		login.Response.AuthPlugin = plugin
+		login.Response.AuthResponse = ScramblePassword(plugin, scramble, []byte("secret"))
+		ok, err := cred.Verify(NewConn(NewBufferConn(nil, nil)), login)
+		assert.Nil(t, err, "verify err")
+		assert.True(t, ok, "verify failed: %s", plugin)
+
+		login.Response.AuthResponse = ScramblePassword(plugin, scramble, []byte("wrong"))
+		ok, err = cred.Verify(NewConn(NewBufferConn(nil, nil)), login)
+		assert.Nil(t, err, "verify err")
+		assert.False(t, ok, "wrong password verified: %s", plugin)
+	}
+}
+
+func TestScramblePassword(t *testing.T) {
+	scramble := []byte{10, 47, 74, 111, 75, 73, 34, 48, 88, 76, 114, 74, 37, 13, 3, 80, 82, 2, 23, 21}
+	response := ScramblePassword(AUTH_CACHING_SHA2_PASSWORD, scramble, []byte("secret"))
+	assert.Equal(t, "f490e76f66d9d86665ce54d98c78d0acfe2fb0b08b423da807144873d30b312c", fmt.Sprintf("%x", response))
+	assert.Len(t, ScramblePassword(AUTH_NATIVE_PASSWORD, scramble, []byte("secret")), 20, "native password scramble err")
+	assert.Empty(t, ScramblePassword(AUTH_NATIVE_PASSWORD, scramble, nil), "empty password scramble err")
+
+	scramble, err := NewScramble()
+	assert.Nil(t, err, "new scramble err")
+	assert.Len(t, scramble, SCRAMBLE_LENGTH, "scramble length err")
+	assert.NotContains(t, scramble, byte(0), "scramble contains 0")
+}
@@ -0,0 +1,72 @@
+package protocol
+
+// https://dev.mysql.com/doc/dev/mysql-server/latest/group__group__cs__capabilities__flags.html
+const (
+	CLIENT_LONG_PASSWORD uint32 = 1 << iota
+	CLIENT_FOUND_ROWS
+	CLIENT_LONG_FLAG
+	CLIENT_CONNECT_WITH_DB
+	CLIENT_NO_SCHEMA
+	CLIENT_COMPRESS
+	CLIENT_ODBC
+	CLIENT_LOCAL_FILES
+	CLIENT_IGNORE_SPACE
+	CLIENT_PROTOCOL_41
+	CLIENT_INTERACTIVE
+	CLIENT_SSL
+	CLIENT_IGNORE_SIGPIPE
+	CLIENT_TRANSACTIONS
+	CLIENT_RESERVED
+	CLIENT_SECURE_CONNECTION
+	CLIENT_MULTI_STATEMENTS
+	CLIENT_MULTI_RESULTS
+	CLIENT_PS_MULTI_RESULTS
+	CLIENT_PLUGIN_AUTH
+	CLIENT_CONNECT_ATTRS
+	CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA
+	CLIENT_CAN_HANDLE_EXPIRED_PASSWORDS
+	CLIENT_SESSION_TRACK
+	CLIENT_DEPRECATE_EOF
+	CLIENT_OPTIONAL_RESULTSET_METADATA
+	CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	CLIENT_QUERY_ATTRIBUTES
+	MULTI_FACTOR_AUTHENTICATION
+	CLIENT_CAPABILITY_EXTENSION
+	CLIENT_SSL_VERIFY_SERVER_CERT
+	CLIENT_REMEMBER_OPTIONS
+)
+
+// 影响会话行为和结果集格式的 capability, 复用连接时需要与客户端协商的一致
+const CLIENT_SESSION_FLAGS = CLIENT_FOUND_ROWS | CLIENT_NO_SCHEMA | CLIENT_ODBC | CLIENT_LOCAL_FILES | CLIENT_IGNORE_SPACE |
+	CLIENT_INTERACTIVE | CLIENT_MULTI_STATEMENTS | CLIENT_MULTI_RESULTS | CLIENT_PS_MULTI_RESULTS | CLIENT_SESSION_TRACK |
+	CLIENT_DEPRECATE_EOF | CLIENT_OPTIONAL_RESULTSET_METADATA | CLIENT_QUERY_ATTRIBUTES
+
+// 代理不能转发的 capability, 从握手包和客户端的响应中去掉
+// 压缩只在代理与 mysql 之间使用, 多因素认证的流程代理不支持
+const CLIENT_PROXY_UNSUPPORTED = CLIENT_COMPRESS | CLIENT_ZSTD_COMPRESSION_ALGORITHM |
+	MULTI_FACTOR_AUTHENTICATION | CLIENT_CAPABILITY_EXTENSION | CLIENT_SSL_VERIFY_SERVER_CERT | CLIENT_REMEMBER_OPTIONS
+
+type (
+	// 代理与客户端之间协商 capability
+	Capabilities struct {
+		// 代理配置去掉的标志, 比如拒绝 LOCAL INFILE 时的 CLIENT_LOCAL_FILES
+		Disabled uint32
+		// 代理可以接受客户端的 SSL, unix socket 上不需要
+		SSL bool
+	}
+)
+
+// 发给客户端的握手包中的 capability
+func (c Capabilities) Handshake(server uint32) uint32 {
+	capability := server &^ (CLIENT_PROXY_UNSUPPORTED | c.Disabled | CLIENT_SSL)
+	if c.SSL {
+		capability |= CLIENT_SSL
+	}
+	return capability
+}
+
+// 去掉客户端响应中代理不支持的标志, 协商结果记录到 session, 之后按它解析响应
+func (c Capabilities) Negotiate(handshake uint32, resp *HandshakeResponse, session *Session) {
+	resp.Capability &^= CLIENT_PROXY_UNSUPPORTED | c.Disabled
+	session.Capability = resp.Capability & handshake
+}
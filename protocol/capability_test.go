@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	server := CLIENT_BASIC_FLAGS | CLIENT_SSL | CLIENT_COMPRESS | CLIENT_LOCAL_FILES | CLIENT_QUERY_ATTRIBUTES | CLIENT_DEPRECATE_EOF
+	caps := Capabilities{Disabled: CLIENT_LOCAL_FILES}
+
+	hs := caps.Handshake(server)
+	assert.Equal(t, CLIENT_BASIC_FLAGS|CLIENT_QUERY_ATTRIBUTES|CLIENT_DEPRECATE_EOF, hs, "handshake capability err")
+	caps.SSL = true
+	assert.Equal(t, CLIENT_BASIC_FLAGS|CLIENT_QUERY_ATTRIBUTES|CLIENT_DEPRECATE_EOF|CLIENT_SSL, caps.Handshake(server), "ssl capability err")
+
+	// 客户端请求了不支持的标志
+	resp := HandshakeResponse{Capability: CLIENT_BASIC_FLAGS | CLIENT_COMPRESS | CLIENT_LOCAL_FILES | CLIENT_MULTI_STATEMENTS | CLIENT_DEPRECATE_EOF}
+	session := &Session{}
+	caps.Negotiate(hs, &resp, session)
+	assert.Equal(t, CLIENT_BASIC_FLAGS|CLIENT_MULTI_STATEMENTS|CLIENT_DEPRECATE_EOF, resp.Capability, "response capability err")
+	assert.Equal(t, CLIENT_BASIC_FLAGS|CLIENT_DEPRECATE_EOF, session.Capability, "session capability err")
+	assert.True(t, session.DeprecateEOF(), "deprecate eof not negotiated")
+}
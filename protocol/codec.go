@@ -0,0 +1,30 @@
+package protocol
+
+// 长度编码的整数和字符串
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_dt_integers.html
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_dt_strings.html
+
+// 文本协议数据行中的 NULL
+const NULL_VALUE byte = 0xfb
+
+func AppendLenEncInt(b []byte, n uint64) []byte {
+	return append(b, lenEncInt(n)...)
+}
+
+func AppendLenEncString(b []byte, s []byte) []byte {
+	return append(AppendLenEncInt(b, uint64(len(s))), s...)
+}
+
+// 读取长度编码的整数, 返回整数和占用的字节数
+func ReadLenEncInt(data []byte) (uint64, int, error) {
+	r := reader{data: data}
+	n := r.lenEncInt()
+	return n, r.pos, r.err
+}
+
+// 读取长度编码的字符串, 返回字符串和占用的字节数
+func ReadLenEncString(data []byte) ([]byte, int, error) {
+	r := reader{data: data}
+	s := r.lenEncBytes()
+	return s, r.pos, r.err
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLenEncInt(t *testing.T) {
+	for _, n := range []uint64{0, 250, 251, 0xffff, 0x10000, 0xffffff, 0x1000000, 1<<64 - 1} {
+		b := AppendLenEncInt(nil, n)
+		v, size, err := ReadLenEncInt(append(b, 'x'))
+		assert.Nil(t, err, "read %d err", n)
+		assert.Equal(t, n, v, "value err")
+		assert.Equal(t, len(b), size, "size of %d err", n)
+	}
+
+	_, _, err := ReadLenEncInt([]byte{0xfd, 1})
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func TestLenEncString(t *testing.T) {
+	b := AppendLenEncString(nil, []byte("umyproxy"))
+	s, size, err := ReadLenEncString(b)
+	assert.Nil(t, err, "read string err")
+	assert.Equal(t, []byte("umyproxy"), s, "string err")
+	assert.Equal(t, 9, size, "size err")
+
+	_, _, err = ReadLenEncString(b[:5])
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func TestOkPacketCodec(t *testing.T) {
+	ok := OkPacket{AffectedRows: 300, LastInsertId: 7, Status: SERVER_STATUS_AUTOCOMMIT, Warnings: 1, Info: []byte{0, 1, 2}}
+	parsed, err := ParseOkPacket(ok.Encode())
+	assert.Nil(t, err, "parse ok err")
+	assert.Equal(t, ok, parsed, "ok packet err")
+	assert.True(t, IsOkPacket(Packet{Payload: ok.Encode()}), "ok header err")
+
+	// CLIENT_DEPRECATE_EOF 时结果集结尾的 OK 包
+	ok.Info = nil
+	session := &Session{Capability: CLIENT_DEPRECATE_EOF}
+	end := Packet{Payload: ok.EncodeEOF()}
+	assert.True(t, session.IsResultSetEnd(end), "result set end err")
+	parsed, err = ParseOkPacket(end.Payload)
+	assert.Nil(t, err, "parse eof ok err")
+	assert.Equal(t, ok, parsed, "eof ok packet err")
+}
+
+func TestEofPacketCodec(t *testing.T) {
+	eof := EofPacket{Warnings: 2, Status: SERVER_STATUS_IN_TRANS}
+	parsed, err := ParseEofPacket(eof.Encode())
+	assert.Nil(t, err, "parse eof err")
+	assert.Equal(t, eof, parsed, "eof packet err")
+	assert.True(t, IsEofPacket(Packet{Payload: eof.Encode()}), "eof header err")
+}
+
+func TestErrPacketCodec(t *testing.T) {
+	e := &SQLError{Code: ER_ACCESS_DENIED_ERROR, State: "28000", Message: "Access denied"}
+	p := Packet{Payload: e.Encode()}
+	assert.True(t, IsErrPacket(p), "err header err")
+	assert.Equal(t, e, ParseErrPacket(p), "err packet err")
+}
+
+func TestAuthSwitchCodec(t *testing.T) {
+	p := AuthSwitchPacket(AUTH_CACHING_SHA2_PASSWORD, []byte("12345678901234567890"), 2)
+	assert.True(t, IsAuthSwitchPacket(p), "auth switch header err")
+	plugin, data, err := ParseAuthSwitch(p.Payload)
+	assert.Nil(t, err, "parse auth switch err")
+	assert.Equal(t, AUTH_CACHING_SHA2_PASSWORD, plugin, "plugin err")
+	assert.Equal(t, []byte("12345678901234567890"), data, "auth data err")
+}
+
+func TestColumnDefinitionCodec(t *testing.T) {
+	col := ColumnDefinition{
+		Catalog: "def", Schema: "test", Table: "u", OrgTable: "users", Name: "n", OrgName: "name",
+		Charset: 45, Length: 1020, Type: MYSQL_TYPE_VAR_STRING, Flags: 0x1001, Decimals: 0,
+	}
+	parsed, err := ParseColumnDefinition(col.Encode())
+	assert.Nil(t, err, "parse column err")
+	assert.Equal(t, col, parsed, "column err")
+
+	// COM_FIELD_LIST 带有默认值
+	col.Default = []byte("x")
+	parsed, err = ParseColumnDefinition(col.Encode())
+	assert.Nil(t, err, "parse field list column err")
+	assert.Equal(t, col, parsed, "field list column err")
+
+	_, err = ParseColumnDefinition(col.Encode()[:20])
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func TestTextRowCodec(t *testing.T) {
+	row := Row{[]byte("1"), nil, []byte{}, []byte("abc")}
+	parsed, err := ParseTextRow(row.EncodeText(), len(row))
+	assert.Nil(t, err, "parse text row err")
+	assert.Equal(t, row, parsed, "text row err")
+
+	_, err = ParseTextRow(row.EncodeText(), 3)
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func TestBinaryRowCodec(t *testing.T) {
+	columns := []ColumnDefinition{
+		{Type: MYSQL_TYPE_LONGLONG},
+		{Type: MYSQL_TYPE_VAR_STRING},
+		{Type: MYSQL_TYPE_TINY},
+		{Type: MYSQL_TYPE_DATETIME},
+		{Type: MYSQL_TYPE_DOUBLE},
+		{Type: MYSQL_TYPE_SHORT},
+		{Type: MYSQL_TYPE_BLOB},
+	}
+	row := Row{
+		{1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte("abc"),
+		nil,
+		{0xe8, 0x07, 10, 18, 3, 4, 5},
+		nil,
+		{2, 0},
+		[]byte{},
+	}
+	data := row.EncodeBinary(columns)
+	// 第 3 和第 5 列为 NULL, bitmap 偏移 2 位
+	assert.Equal(t, []byte{OK_PACKET, 0x50, 0}, data[:3], "null bitmap err")
+	parsed, err := ParseBinaryRow(data, columns)
+	assert.Nil(t, err, "parse binary row err")
+	assert.Equal(t, row, parsed, "binary row err")
+
+	_, err = ParseBinaryRow(data[:len(data)-2], columns)
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func TestPrepareOkCodec(t *testing.T) {
+	ok := PrepareOk{StatementId: 9, Columns: 2, Params: 1, Warnings: 3, Metadata: RESULTSET_METADATA_FULL}
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+	parsed, err := session.ParsePrepareOk(Packet{Payload: ok.Encode(session.Capability)})
+	assert.Nil(t, err, "parse prepare ok err")
+	assert.Equal(t, ok, parsed, "prepare ok err")
+
+	ok.Metadata = RESULTSET_METADATA_NONE
+	session.Capability |= CLIENT_OPTIONAL_RESULTSET_METADATA
+	parsed, err = session.ParsePrepareOk(Packet{Payload: ok.Encode(session.Capability)})
+	assert.Nil(t, err, "parse prepare ok metadata err")
+	assert.Equal(t, ok, parsed, "prepare ok metadata err")
+	assert.Zero(t, session.PrepareDefinitions(parsed), "definitions without metadata")
+}
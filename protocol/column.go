@@ -0,0 +1,110 @@
+package protocol
+
+import "fmt"
+
+// 字段类型
+// https://dev.mysql.com/doc/dev/mysql-server/latest/field__types_8h.html
+const (
+	MYSQL_TYPE_DECIMAL     byte = 0x00
+	MYSQL_TYPE_TINY        byte = 0x01
+	MYSQL_TYPE_SHORT       byte = 0x02
+	MYSQL_TYPE_LONG        byte = 0x03
+	MYSQL_TYPE_FLOAT       byte = 0x04
+	MYSQL_TYPE_DOUBLE      byte = 0x05
+	MYSQL_TYPE_NULL        byte = 0x06
+	MYSQL_TYPE_TIMESTAMP   byte = 0x07
+	MYSQL_TYPE_LONGLONG    byte = 0x08
+	MYSQL_TYPE_INT24       byte = 0x09
+	MYSQL_TYPE_DATE        byte = 0x0a
+	MYSQL_TYPE_TIME        byte = 0x0b
+	MYSQL_TYPE_DATETIME    byte = 0x0c
+	MYSQL_TYPE_YEAR        byte = 0x0d
+	MYSQL_TYPE_NEWDATE     byte = 0x0e
+	MYSQL_TYPE_VARCHAR     byte = 0x0f
+	MYSQL_TYPE_BIT         byte = 0x10
+	MYSQL_TYPE_TIMESTAMP2  byte = 0x11
+	MYSQL_TYPE_DATETIME2   byte = 0x12
+	MYSQL_TYPE_TIME2       byte = 0x13
+	MYSQL_TYPE_TYPED_ARRAY byte = 0x14
+	MYSQL_TYPE_VECTOR      byte = 0xf2
+	MYSQL_TYPE_INVALID     byte = 0xf3
+	MYSQL_TYPE_BOOL        byte = 0xf4
+	MYSQL_TYPE_JSON        byte = 0xf5
+	MYSQL_TYPE_NEWDECIMAL  byte = 0xf6
+	MYSQL_TYPE_ENUM        byte = 0xf7
+	MYSQL_TYPE_SET         byte = 0xf8
+	MYSQL_TYPE_TINY_BLOB   byte = 0xf9
+	MYSQL_TYPE_MEDIUM_BLOB byte = 0xfa
+	MYSQL_TYPE_LONG_BLOB   byte = 0xfb
+	MYSQL_TYPE_BLOB        byte = 0xfc
+	MYSQL_TYPE_VAR_STRING  byte = 0xfd
+	MYSQL_TYPE_STRING      byte = 0xfe
+	MYSQL_TYPE_GEOMETRY    byte = 0xff
+)
+
+type (
+	// Protocol::ColumnDefinition41
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response_text_resultset_column_definition.html
+	ColumnDefinition struct {
+		Catalog  string
+		Schema   string
+		Table    string
+		OrgTable string
+		Name     string
+		OrgName  string
+		Charset  uint16
+		Length   uint32
+		Type     byte
+		Flags    uint16
+		Decimals byte
+		// COM_FIELD_LIST 响应中的默认值
+		Default []byte
+	}
+)
+
+// 固定长度部分的长度, 总是 0x0c
+const columnFixedLength = 0x0c
+
+func ParseColumnDefinition(data []byte) (ColumnDefinition, error) {
+	col := ColumnDefinition{}
+	r := reader{data: data}
+	col.Catalog = string(r.lenEncBytes())
+	col.Schema = string(r.lenEncBytes())
+	col.Table = string(r.lenEncBytes())
+	col.OrgTable = string(r.lenEncBytes())
+	col.Name = string(r.lenEncBytes())
+	col.OrgName = string(r.lenEncBytes())
+	if n := r.lenEncInt(); r.err == nil && n != columnFixedLength {
+		return col, fmt.Errorf("column fixed length %d: %w", n, ErrMalformedPacket)
+	}
+	col.Charset = r.uint16()
+	col.Length = r.uint32()
+	col.Type = r.byte()
+	col.Flags = r.uint16()
+	col.Decimals = r.byte()
+	r.skip(2)
+	if r.err == nil && !r.eof() {
+		col.Default = append([]byte{}, r.lenEncBytes()...)
+	}
+	if r.err != nil {
+		return col, fmt.Errorf("parse column definition err: %w", r.err)
+	}
+	return col, nil
+}
+
+func (c ColumnDefinition) Encode() []byte {
+	b := make([]byte, 0, 32+len(c.Schema)+len(c.Table)+len(c.OrgTable)+len(c.Name)+len(c.OrgName))
+	for _, s := range []string{c.Catalog, c.Schema, c.Table, c.OrgTable, c.Name, c.OrgName} {
+		b = AppendLenEncString(b, []byte(s))
+	}
+	b = AppendLenEncInt(b, columnFixedLength)
+	b = append(b, uint16Bytes(c.Charset)...)
+	b = append(b, uint32Bytes(c.Length)...)
+	b = append(b, c.Type)
+	b = append(b, uint16Bytes(c.Flags)...)
+	b = append(b, c.Decimals, 0, 0)
+	if c.Default != nil {
+		b = AppendLenEncString(b, c.Default)
+	}
+	return b
+}
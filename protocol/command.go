@@ -1,30 +1,103 @@
 package protocol
 
+import "fmt"
+
 // https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_command_phase.html
+// https://dev.mysql.com/doc/dev/mysql-server/latest/my__command_8h.html
 const (
     // Text Protocol
-    COM_QUERY = 0x03 
+    COM_QUERY = 0x03
 
     // Utility Commands
+    COM_SLEEP = 0x00
     COM_QUIT = 0x01
     COM_INIT_DB = 0x02
     COM_FIELD_LIST = 0x04
+    COM_CREATE_DB = 0x05
+    COM_DROP_DB = 0x06
     COM_REFRESH = 0x07
-    COM_STATISTICS = 0x08
+    COM_SHUTDOWN = 0x08
+    COM_STATISTICS = 0x09
     COM_PROCESS_INFO = 0x0A
+    COM_CONNECT = 0x0B
     COM_PROCESS_KILL = 0x0C
     COM_DEBUG = 0x0D
-    COM_PING = 0x1E
+    COM_PING = 0x0E
+    COM_TIME = 0x0F
+    COM_DELAYED_INSERT = 0x10
     COM_CHANGE_USER = 0x11
+    COM_SET_OPTION = 0x1B
+    COM_DAEMON = 0x1D
     COM_RESET_CONNECTION = 0x1F
-    COM_SET_OPTION = 0x1A
+    COM_CLONE = 0x20
+
+    // Replication Protocol
+    COM_BINLOG_DUMP = 0x12
+    COM_TABLE_DUMP = 0x13
+    COM_CONNECT_OUT = 0x14
+    COM_REGISTER_SLAVE = 0x15
+    COM_BINLOG_DUMP_GTID = 0x1E
+    COM_SUBSCRIBE_GROUP_REPLICATION_STREAM = 0x21
 
     // Prepared Statements
     COM_STMT_PREPARE = 0x16
     COM_STMT_EXECUTE = 0x17
-    COM_STMT_FETCH = 0x19
+    COM_STMT_SEND_LONG_DATA = 0x18
     COM_STMT_CLOSE = 0x19
     COM_STMT_RESET = 0x1A
-    COM_STMT_SEND_LONG_DATA = 0x18
+    COM_STMT_FETCH = 0x1C
+)
 
+// COM_STMT_EXECUTE 的 flags
+const (
+    CURSOR_TYPE_NO_CURSOR byte = 0x00
+    CURSOR_TYPE_READ_ONLY byte = 0x01
+    CURSOR_TYPE_FOR_UPDATE byte = 0x02
+    CURSOR_TYPE_SCROLLABLE byte = 0x04
+    PARAMETER_COUNT_AVAILABLE byte = 0x08
 )
+
+var commandNames = map[byte]string{
+    COM_SLEEP: "COM_SLEEP",
+    COM_QUIT: "COM_QUIT",
+    COM_INIT_DB: "COM_INIT_DB",
+    COM_QUERY: "COM_QUERY",
+    COM_FIELD_LIST: "COM_FIELD_LIST",
+    COM_CREATE_DB: "COM_CREATE_DB",
+    COM_DROP_DB: "COM_DROP_DB",
+    COM_REFRESH: "COM_REFRESH",
+    COM_SHUTDOWN: "COM_SHUTDOWN",
+    COM_STATISTICS: "COM_STATISTICS",
+    COM_PROCESS_INFO: "COM_PROCESS_INFO",
+    COM_CONNECT: "COM_CONNECT",
+    COM_PROCESS_KILL: "COM_PROCESS_KILL",
+    COM_DEBUG: "COM_DEBUG",
+    COM_PING: "COM_PING",
+    COM_TIME: "COM_TIME",
+    COM_DELAYED_INSERT: "COM_DELAYED_INSERT",
+    COM_CHANGE_USER: "COM_CHANGE_USER",
+    COM_BINLOG_DUMP: "COM_BINLOG_DUMP",
+    COM_TABLE_DUMP: "COM_TABLE_DUMP",
+    COM_CONNECT_OUT: "COM_CONNECT_OUT",
+    COM_REGISTER_SLAVE: "COM_REGISTER_SLAVE",
+    COM_STMT_PREPARE: "COM_STMT_PREPARE",
+    COM_STMT_EXECUTE: "COM_STMT_EXECUTE",
+    COM_STMT_SEND_LONG_DATA: "COM_STMT_SEND_LONG_DATA",
+    COM_STMT_CLOSE: "COM_STMT_CLOSE",
+    COM_STMT_RESET: "COM_STMT_RESET",
+    COM_SET_OPTION: "COM_SET_OPTION",
+    COM_STMT_FETCH: "COM_STMT_FETCH",
+    COM_DAEMON: "COM_DAEMON",
+    COM_BINLOG_DUMP_GTID: "COM_BINLOG_DUMP_GTID",
+    COM_RESET_CONNECTION: "COM_RESET_CONNECTION",
+    COM_CLONE: "COM_CLONE",
+    COM_SUBSCRIBE_GROUP_REPLICATION_STREAM: "COM_SUBSCRIBE_GROUP_REPLICATION_STREAM",
+}
+
+// 命令名称, 用于日志
+func CommandName(cmd byte) string {
+    if name, ok := commandNames[cmd]; ok {
+        return name
+    }
+    return fmt.Sprintf("COM_UNKNOWN(0x%02x)", cmd)
+}
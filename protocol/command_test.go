@@ -0,0 +1,13 @@
+package protocol
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+)
+
+func TestCommandName(t *testing.T) {
+    assert.Equal(t, "COM_STMT_FETCH", CommandName(COM_STMT_FETCH), "fetch name err")
+    assert.Equal(t, "COM_SET_OPTION", CommandName(COM_SET_OPTION), "set option name err")
+    assert.Equal(t, "COM_UNKNOWN(0xff)", CommandName(0xff), "unknown name err")
+}
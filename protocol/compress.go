@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+const (
+	// 压缩包头: 压缩后长度 3 字节, 序号 1 字节, 压缩前长度 3 字节
+	COMPRESS_HEADER_LEN = 7
+	// 小于这个长度时不压缩, 压缩前长度为 0
+	MIN_COMPRESS_LENGTH = 50
+)
+
+// 与服务端协商 CLIENT_COMPRESS, 认证成功后的包使用 zlib 压缩
+// zstd (CLIENT_ZSTD_COMPRESSION_ALGORITHM) 标准库不支持, 不会协商
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_compression.html
+func (c *Conn) SetCompress() {
+	c.compressRequest = true
+}
+
+// 认证前按服务端的 capability 设置压缩标志
+func (c *Conn) compressCapability(hs Handshake, capability uint32) uint32 {
+	capability &^= CLIENT_COMPRESS | CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	if c.compressRequest && hs.Capability&CLIENT_COMPRESS != 0 {
+		capability |= CLIENT_COMPRESS
+	}
+	c.compressNegotiated = capability&CLIENT_COMPRESS != 0
+	return capability
+}
+
+// 认证成功, 之后的包都是压缩格式
+func (c *Conn) startCompress() {
+	if c.compressNegotiated && c.compress == nil {
+		c.compress = &compressReader{conn: c}
+	}
+}
+
+// 是否使用压缩协议
+func (c *Conn) Compressed() bool {
+	return c.compress != nil
+}
+
+// 从压缩包中读取解压后的数据, 一个压缩包可以包含多个或者半个 mysql 包
+type compressReader struct {
+	conn   *Conn
+	buf    bytes.Buffer
+	header [COMPRESS_HEADER_LEN]byte
+	// 解压时复用
+	src bytes.Reader
+	zr  io.ReadCloser
+}
+
+func (r *compressReader) Read(p []byte) (int, error) {
+	if r.buf.Len() == 0 {
+		if err := r.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *compressReader) readFrame() error {
+	header := r.header[:]
+	if _, err := io.ReadFull(r.conn.br, header); err != nil {
+		return fmt.Errorf("read compressed header err: %w", err)
+	}
+	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	r.conn.compressSeq = header[3] + 1
+	uncompressed := int(uint32(header[4]) | uint32(header[5])<<8 | uint32(header[6])<<16)
+
+	data := getBuffer(length)
+	defer putBuffer(data)
+	if _, err := io.ReadFull(r.conn.br, data); err != nil {
+		return fmt.Errorf("read compressed payload err: %w", err)
+	}
+	if uncompressed == 0 {
+		r.buf.Write(data)
+		return nil
+	}
+
+	r.src.Reset(data)
+	if r.zr == nil {
+		zr, err := zlib.NewReader(&r.src)
+		if err != nil {
+			return fmt.Errorf("zlib reader err: %w", err)
+		}
+		r.zr = zr
+	} else if err := r.zr.(zlib.Resetter).Reset(&r.src, nil); err != nil {
+		return fmt.Errorf("zlib reader err: %w", err)
+	}
+	n, err := r.buf.ReadFrom(r.zr)
+	if err != nil {
+		return fmt.Errorf("zlib decompress err: %w", err)
+	}
+	if int(n) != uncompressed {
+		return fmt.Errorf("decompressed length err: %d(%d): %w", n, uncompressed, ErrMalformedPacket)
+	}
+	return nil
+}
+
+// 把 mysql 包的数据按压缩格式写入, 每个压缩包压缩前不超过 MAX_PAYLOAD_LEN
+func (c *Conn) writeCompressed(data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > MAX_PAYLOAD_LEN {
+			n = MAX_PAYLOAD_LEN
+		}
+		if err := c.writeFrame(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (c *Conn) writeFrame(data []byte) error {
+	payload := data
+	uncompressed := 0
+	if len(data) >= MIN_COMPRESS_LENGTH {
+		var b bytes.Buffer
+		zw := zlib.NewWriter(&b)
+		if _, err := zw.Write(data); err != nil {
+			return fmt.Errorf("zlib compress err: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("zlib compress err: %w", err)
+		}
+		// 压缩后更大时发送原数据
+		if b.Len() < len(data) {
+			payload = b.Bytes()
+			uncompressed = len(data)
+		}
+	}
+
+	c.cheader = [COMPRESS_HEADER_LEN]byte{
+		byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16),
+		c.compressSeq,
+		byte(uncompressed), byte(uncompressed >> 8), byte(uncompressed >> 16),
+	}
+	c.compressSeq++
+	if _, err := c.bw.Write(c.cheader[:]); err != nil {
+		return fmt.Errorf("write compressed packet err: %w", err)
+	}
+	if _, err := c.bw.Write(payload); err != nil {
+		return fmt.Errorf("write compressed packet err: %w", err)
+	}
+	return nil
+}
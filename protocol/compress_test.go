@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCompressConn(conn net.Conn) *Conn {
+	c := NewConn(conn).(*Conn)
+	c.SetCompress()
+	c.compressNegotiated = true
+	c.startCompress()
+	return c
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	buf := NewBufferConn(nil, nil)
+	w := newCompressConn(buf)
+
+	small := Packet{Payload: []byte{COM_PING}}
+	large := Packet{Payload: append([]byte{COM_QUERY}, bytes.Repeat([]byte("SELECT 1;"), 100)...), SeqId: 1}
+	assert.Nil(t, w.WritePacket(small), "write small packet err")
+	assert.Nil(t, w.WritePacket(large), "write large packet err")
+	assert.Equal(t, uint8(2), w.compressSeq, "compress seq err")
+
+	// 小包不压缩, 压缩前长度为 0
+	data := buf.writeBuffer.Bytes()
+	assert.Equal(t, []byte{5, 0, 0, 0, 0, 0, 0}, data[:COMPRESS_HEADER_LEN], "small header err")
+	assert.Less(t, buf.writeBuffer.Len(), 2*COMPRESS_HEADER_LEN+5+len(large.Payload)+4, "large packet not compressed")
+
+	r := newCompressConn(NewBufferConn(nil, buf.writeBuffer.Bytes()))
+	p, err := r.ReadPacket()
+	assert.Nil(t, err, "read small packet err")
+	assert.Equal(t, small, p, "small packet err")
+	p, err = r.ReadPacket()
+	assert.Nil(t, err, "read large packet err")
+	assert.Equal(t, large, p, "large packet err")
+	assert.Equal(t, uint8(2), r.compressSeq, "read compress seq err")
+
+	// 复用解压的 zlib reader
+	large.SeqId = 2
+	assert.Nil(t, w.WritePacket(large), "write large packet err")
+	r = newCompressConn(NewBufferConn(nil, buf.writeBuffer.Bytes()))
+	for _, want := range []Packet{small, {Payload: large.Payload, SeqId: 1}, large} {
+		p, err = r.ReadPacket()
+		assert.Nil(t, err, "read packet err")
+		assert.Equal(t, want, p, "packet err")
+	}
+}
+
+func TestCompressCapability(t *testing.T) {
+	c := NewConn(nil).(*Conn)
+	hs := Handshake{Capability: CLIENT_PROTOCOL_41 | CLIENT_COMPRESS}
+
+	// 没有配置压缩时去掉客户端的压缩标志
+	assert.Equal(t, CLIENT_PROTOCOL_41, c.compressCapability(hs, CLIENT_PROTOCOL_41|CLIENT_COMPRESS), "compress not cleared")
+
+	c.SetCompress()
+	assert.Equal(t, CLIENT_PROTOCOL_41|CLIENT_COMPRESS, c.compressCapability(hs, CLIENT_PROTOCOL_41|CLIENT_ZSTD_COMPRESSION_ALGORITHM), "compress not negotiated")
+	c.startCompress()
+	assert.True(t, c.Compressed(), "compress not started")
+
+	// 服务端不支持
+	c = NewConn(nil).(*Conn)
+	c.SetCompress()
+	assert.Equal(t, CLIENT_PROTOCOL_41, c.compressCapability(Handshake{Capability: CLIENT_PROTOCOL_41}, CLIENT_PROTOCOL_41), "compress negotiated")
+	c.startCompress()
+	assert.False(t, c.Compressed(), "compress started")
+}
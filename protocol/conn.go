@@ -1,6 +1,9 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -11,7 +14,11 @@ type (
     Connector interface {
         ReadPacket() (Packet, error)
         WritePacket(Packet) error
-        Auth(Connector) error
+        Handshake() (Handshake, error)
+        Auth(Connector, *Login) error
+        Connect(Account) error
+        Reset(string) error
+        ChangeUser(Account) error
         Closed() bool
         Expired(time.Duration) bool
         RefreshUseTime()
@@ -20,61 +27,99 @@ type (
 
     Conn struct {
         c net.Conn
-        initHandPacket Packet
+        // 带缓冲的读写, hold 时写入的包留在缓冲中直到 Flush
+        br *bufio.Reader
+        bw *bufio.Writer
+        hold bool
+        // 读写包头使用, 避免每个包分配
+        header [4]byte
+        wheader [4]byte
+        cheader [COMPRESS_HEADER_LEN]byte
+        handshake Handshake
+        handshakeRead bool
         authSuccessPacket Packet
         authSuccess bool
         usedTime time.Time
         closed bool
+        tlsConfig *tls.Config
+        tlsRequired bool
+        // 登录 mysql 时发送的 capability
+        capability uint32
+        // 压缩协议
+        compressRequest bool
+        compressNegotiated bool
+        compress *compressReader
+        compressSeq uint8
     }
 
 )
 
+// 连接读写缓冲的大小
+const CONN_BUFFER_SIZE = 16 << 10
+
 func NewConn(c net.Conn) Connector {
-    return &Conn{c:c, usedTime: time.Now()}
+    return newConn(c)
+}
+
+func newConn(c net.Conn) *Conn {
+    return &Conn{
+        c: c,
+        br: bufio.NewReaderSize(c, CONN_BUFFER_SIZE),
+        bw: bufio.NewWriterSize(c, CONN_BUFFER_SIZE),
+        usedTime: time.Now(),
+    }
 }
 
 func (c *Conn) ReadPacket() (Packet, error) {
+    return c.readPacket(false)
+}
 
+// pooled 时 payload 使用复用的缓冲, 调用方转发后用 ReleasePacket 放回
+func (c *Conn) readPacket(pooled bool) (Packet, error) {
     p := Packet{}
     if c.Closed() {
         return p, ErrConnClosed
     }
 
     // read header
-    header := make([]byte, 4)
-    if _, err := io.ReadFull(c.c, header); err != nil {
-        c.Close()
-        return p, fmt.Errorf("read packet header err: %w", err)
-    }
-
-    p.SeqId = uint8(header[3])
-
-    dataLen := int(uint32(header[0]) | uint32(header[1]) << 8 | uint32(header[2]) << 16)
-    if dataLen < 1 {
-        return p, nil
-    }
-
-    // read body
-    data := make([]byte, dataLen)
-    if _, err := io.ReadFull(c.c, data); err != nil {
-        c.Close()
-        return p, fmt.Errorf("read packet payload err: %w", err)
+    dataLen, seqId, err := c.readHeader()
+    if err != nil {
+        return p, err
     }
-    p.Payload = data
+    p.SeqId = seqId
+
+    // 长度为 MAX_PAYLOAD_LEN 时后面还有拆分的包, 直到长度小于 MAX_PAYLOAD_LEN
+    for dataLen > 0 {
+        // read body
+        start := len(p.Payload)
+        if pooled && start == 0 {
+            p.Payload = getBuffer(dataLen)
+        } else {
+            p.Payload = append(p.Payload, make([]byte, dataLen)...)
+        }
+        if _, err := io.ReadFull(c.reader(), p.Payload[start:]); err != nil {
+            c.Close()
+            return p, fmt.Errorf("read packet payload err: %w", err)
+        }
+        if dataLen < MAX_PAYLOAD_LEN {
+            break
+        }
 
-    if dataLen < MAX_PAYLOAD_LEN {
-        return p, nil
+        if dataLen, _, err = c.readHeader(); err != nil {
+            return p, fmt.Errorf("read split packet err: %w", err)
+        }
     }
+    return p, nil
+}
 
-    // append split packet
-    p2, err := c.ReadPacket()
-    if err != nil {
+// 读取包头, 返回 payload 长度和序号
+func (c *Conn) readHeader() (int, uint8, error) {
+    header := c.header[:]
+    if _, err := io.ReadFull(c.reader(), header); err != nil {
         c.Close()
-        return p, fmt.Errorf("read split packet err: %w", err)
+        return 0, 0, fmt.Errorf("read packet header err: %w", err)
     }
-
-    p.Payload = append(p.Payload, p2.Payload...)
-    return p, nil
+    return int(uint32(header[0]) | uint32(header[1]) << 8 | uint32(header[2]) << 16), header[3], nil
 }
 
 func (c *Conn) WritePacket(p Packet) error {
@@ -82,94 +127,339 @@ func (c *Conn) WritePacket(p Packet) error {
         return ErrConnClosed
     }
 
-    ps := p.Split()
-    for _, p2 := range ps {
-        writeData := append(p2.Header(), p2.Payload...)
-        if n, err := c.c.Write(writeData); err != nil {
+    if c.compress != nil {
+        ps := []Packet{p}
+        if len(p.Payload) >= MAX_PAYLOAD_LEN {
+            ps = p.Split()
+        }
+        // 新命令开始时压缩包序号从 0 开始
+        if p.SeqId == 0 {
+            c.compressSeq = 0
+        }
+        data := getBuffer(len(p.Payload)+4*len(ps))[:0]
+        for _, p2 := range ps {
+            data = append(append(data, p2.Header()...), p2.Payload...)
+        }
+        err := c.writeCompressed(data)
+        putBuffer(data)
+        if err != nil {
+            return err
+        }
+        return c.flushWrites()
+    }
+
+    // 不需要拆分的包直接写入缓冲
+    if len(p.Payload) < MAX_PAYLOAD_LEN {
+        if err := c.writeHeader(len(p.Payload), p.SeqId); err != nil {
+            return err
+        }
+        if _, err := c.bw.Write(p.Payload); err != nil {
+            return fmt.Errorf("write packet err: %w", err)
+        }
+        return c.flushWrites()
+    }
+    for _, p2 := range p.Split() {
+        if err := c.writeHeader(len(p2.Payload), p2.SeqId); err != nil {
+            return err
+        }
+        if _, err := c.bw.Write(p2.Payload); err != nil {
             return fmt.Errorf("write packet err: %w", err)
-        } else if n != len(writeData) {
-            return fmt.Errorf("write packet length err: write(%d) data(%d)", n, len(writeData))
         }
     }
+    return c.flushWrites()
+}
+
+func (c *Conn) writeHeader(length int, seqId uint8) error {
+    c.wheader = [4]byte{byte(length), byte(length >> 8), byte(length >> 16), seqId}
+    if _, err := c.bw.Write(c.wheader[:]); err != nil {
+        return fmt.Errorf("write packet err: %w", err)
+    }
     return nil
 }
 
-func (c *Conn) Auth(client Connector) error {
-    if c.authSuccess {
-        return c.fakeAuth(client)
+// 合并之后写入的包, 直到 Flush 时一起发送
+func (c *Conn) Hold() {
+    c.hold = true
+}
+
+// 发送缓冲中的包, 之后写入的包立即发送
+func (c *Conn) Flush() error {
+    c.hold = false
+    if err := c.bw.Flush(); err != nil {
+        return fmt.Errorf("write packet err: %w", err)
     }
-    return c.firstAuth(client)
+    return nil
 }
 
-func (c *Conn) firstAuth(client Connector) error {
-    var err error
+func (c *Conn) flushWrites() error {
+    if c.hold {
+        return nil
+    }
+    return c.Flush()
+}
+
+func (c *Conn) reader() io.Reader {
+    if c.compress != nil {
+        return c.compress
+    }
+    return c.br
+}
+
+// 升级为 TLS 连接, 握手时先读取缓冲中已经收到的数据
+func (c *Conn) upgrade(upgrade func(net.Conn) *tls.Conn) error {
+    if err := c.bw.Flush(); err != nil {
+        return fmt.Errorf("write packet err: %w", err)
+    }
+    tlsConn := upgrade(&bufferedConn{Conn: c.c, r: c.br})
+    tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        c.Close()
+        return fmt.Errorf("tls handshake err: %w", err)
+    }
+    tlsConn.SetDeadline(time.Time{})
+    c.c = tlsConn
+    c.br = bufio.NewReaderSize(tlsConn, CONN_BUFFER_SIZE)
+    c.bw.Reset(tlsConn)
+    return nil
+}
+
+func (c *Conn) Handshake() (Handshake, error) {
+    if c.handshakeRead {
+        return c.handshake, nil
+    }
+
     initPacket, err := c.ReadPacket()
     if err != nil {
-        return fmt.Errorf("read init packet err: %w", err)
+        return c.handshake, fmt.Errorf("read init packet err: %w", err)
+    }
+    if IsErrPacket(initPacket) {
+        return c.handshake, fmt.Errorf("server refused connection: %w", ErrAuth)
     }
-    c.initHandPacket = initPacket
 
-    // send init packet
-    err = client.WritePacket(c.initHandPacket)
+    hs, err := ParseHandshake(initPacket.Payload)
     if err != nil {
-        return fmt.Errorf("send init err: %w", err)
+        return c.handshake, fmt.Errorf("parse init packet err: %w", err)
+    }
+    c.handshake = hs
+    c.handshakeRead = true
+
+    return c.handshake, nil
+}
+
+// 未登录的连接转发客户端的认证; 已登录的连接上, 代理校验过的客户端直接返回成功, 否则使用 COM_CHANGE_USER 由 mysql 认证
+func (c *Conn) Auth(client Connector, login *Login) error {
+    if !c.authSuccess {
+        return c.firstAuth(client, login)
     }
+    if login.Verified {
+        return c.fakeAuth(client, login)
+    }
+    return c.changeUserAuth(client, login)
+}
 
-    // read auth packet
-    authPacket, err := client.ReadPacket()
+func (c *Conn) firstAuth(client Connector, login *Login) error {
+    var err error
+    hs, err := c.Handshake()
     if err != nil {
-        return fmt.Errorf("read auth packet err: %w", err)
+        return err
+    }
+
+    // 客户端使用的 scramble 与服务端不同时, 让客户端重新计算
+    if !bytes.Equal(hs.AuthData, login.Scramble) {
+        err = c.switchAuth(client, login, hs)
+        if err != nil {
+            return err
+        }
+    }
+
+    // 与服务端之间使用 TLS 时先发送 SSLRequest
+    serverSeq := uint8(1)
+    resp := login.Response
+    resp.Capability &^= CLIENT_SSL
+    // 代理为 mysql 连接加上的 CLIENT_QUERY_ATTRIBUTES 需要服务端支持
+    if hs.Capability&CLIENT_QUERY_ATTRIBUTES == 0 {
+        resp.Capability &^= CLIENT_QUERY_ATTRIBUTES
+    }
+    resp.Capability = c.compressCapability(hs, resp.Capability)
+    upgraded, err := c.startTLS(hs, resp, serverSeq)
+    if err != nil {
+        return err
+    }
+    if upgraded {
+        resp.Capability |= CLIENT_SSL
+        serverSeq++
     }
 
     // send auth to server
-    err = c.WritePacket(authPacket)
+    c.capability = resp.Capability
+    err = c.WritePacket(Packet{Payload: setCapability(login.Packet.Payload, resp.Capability), SeqId: serverSeq})
     if err != nil {
         return fmt.Errorf("send auth packet err: %w", err)
     }
 
-    // read auth result
-    authResult, err := c.ReadPacket()
-    if err != nil {
-        return fmt.Errorf("read auth result err: %w", err)
+    return c.relayAuth(client, login)
+}
+
+// 转发认证过程, 直到 OK 或 ERR
+func (c *Conn) relayAuth(client Connector, login *Login) error {
+    for {
+        // read auth result
+        authResult, err := c.ReadPacket()
+        if err != nil {
+            return fmt.Errorf("read auth result err: %w", err)
+        }
+        serverSeq := authResult.SeqId
+
+        // send auth result
+        authResult.SeqId = login.Packet.SeqId + 1
+        err = client.WritePacket(authResult)
+        if err != nil {
+            return fmt.Errorf("send result err: %w", err)
+        }
+        login.Packet.SeqId = authResult.SeqId
+
+        if IsErrPacket(authResult) {
+            return ErrAuth
+        }
+
+        if IsOkPacket(authResult) {
+            c.authSuccessPacket = authResult
+            c.authSuccess = true
+            c.startCompress()
+            return nil
+        }
+
+        // 服务端要求切换认证插件, 客户端重新计算 auth-response
+        if IsAuthSwitchPacket(authResult) {
+            plugin, scramble, err := ParseAuthSwitch(authResult.Payload)
+            if err != nil {
+                return fmt.Errorf("parse auth switch err: %w", err)
+            }
+            reply, err := client.ReadPacket()
+            if err != nil {
+                return fmt.Errorf("read auth switch response err: %w", err)
+            }
+            login.Packet.SeqId = reply.SeqId
+            login.Response.AuthPlugin = plugin
+            login.Response.AuthResponse = reply.Payload
+            login.Scramble = scramble
+
+            serverSeq++
+            reply.SeqId = serverSeq
+            err = c.WritePacket(reply)
+            if err != nil {
+                return fmt.Errorf("send auth switch response err: %w", err)
+            }
+            continue
+        }
+
+        if !IsAuthMoreDataPacket(authResult) {
+            return fmt.Errorf("unexpected auth packet: %w", ErrMalformedPacket)
+        }
+
+        // caching_sha2_password 快速认证成功, 之后是 OK 包
+        if len(authResult.Payload) == 2 && authResult.Payload[1] == CACHING_SHA2_FAST_AUTH_SUCCESS {
+            continue
+        }
+
+        // 客户端数据发送给服务端
+        reply, err := client.ReadPacket()
+        if err != nil {
+            return fmt.Errorf("read auth data err: %w", err)
+        }
+        login.Packet.SeqId = reply.SeqId
+
+        // 完整认证时安全连接上的客户端发送明文密码
+        if len(authResult.Payload) == 2 && authResult.Payload[1] == CACHING_SHA2_FULL_AUTH && IsSecure(client) {
+            login.Password = bytes.TrimSuffix(reply.Payload, []byte{0})
+            if !c.Secure() {
+                reply.Payload, serverSeq, err = c.encryptPassword(login.Password, login.Scramble, serverSeq)
+                if err != nil {
+                    return err
+                }
+            }
+        }
+
+        serverSeq++
+        reply.SeqId = serverSeq
+        err = c.WritePacket(reply)
+        if err != nil {
+            return fmt.Errorf("send auth data err: %w", err)
+        }
     }
+}
 
-    // send auth result
-    err = client.WritePacket(authResult)
+// 向服务端请求 RSA 公钥并加密密码
+func (c *Conn) encryptPassword(password, scramble []byte, seqId uint8) ([]byte, uint8, error) {
+    err := c.WritePacket(Packet{Payload: []byte{CACHING_SHA2_REQUEST_PUBLIC_KEY}, SeqId: seqId + 1})
     if err != nil {
-        return fmt.Errorf("send result err: %w", err)
+        return nil, seqId, fmt.Errorf("request public key err: %w", err)
     }
 
-    if IsErrPacket(authResult) {
-        return ErrAuth
+    keyPacket, err := c.ReadPacket()
+    if err != nil {
+        return nil, seqId, fmt.Errorf("read public key err: %w", err)
+    }
+    if !IsAuthMoreDataPacket(keyPacket) {
+        return nil, seqId, fmt.Errorf("read public key err: %w", ErrMalformedPacket)
     }
 
-    c.authSuccessPacket = authResult
-    c.authSuccess = true
-
-    return nil
+    encrypted, err := EncryptPassword(password, scramble, keyPacket.Payload[1:])
+    if err != nil {
+        return nil, seqId, err
+    }
+    return encrypted, keyPacket.SeqId, nil
 }
 
-func (c *Conn) fakeAuth(client Connector) error {
-    if c.authSuccess == false {
-        return ErrNoAuth
+// 发送 AuthSwitchRequest, 使用服务端的 scramble 重新认证
+func (c *Conn) switchAuth(client Connector, login *Login, hs Handshake) error {
+    plugin := login.Response.AuthPlugin
+    if plugin == "" {
+        plugin = hs.AuthPlugin
     }
+    return SwitchAuth(client, login, plugin, hs.AuthData)
+}
 
-    var err error
-
-    // send init packet
-    err = client.WritePacket(c.initHandPacket)
+// COM_CHANGE_USER 的 auth-response 使用连接握手时的 scramble, 客户端切换到该 scramble 重新计算
+// 认证失败时 mysql 会断开连接, 连接不再是已登录状态
+func (c *Conn) changeUserAuth(client Connector, login *Login) error {
+    hs, err := c.Handshake()
     if err != nil {
-        return fmt.Errorf("send init err: %w", err)
+        return err
+    }
+    if !bytes.Equal(hs.AuthData, login.Scramble) {
+        if err := c.switchAuth(client, login, hs); err != nil {
+            return err
+        }
     }
 
-    // read auth packet
-    _, err = client.ReadPacket()
+    resp := login.Response
+    err = c.WritePacket(Packet{Payload: changeUserPayload(resp.User, resp.AuthResponse, resp.Database, resp.Charset, resp.AuthPlugin)})
     if err != nil {
-        return fmt.Errorf("read auth packet err: %w", err)
+        return fmt.Errorf("send change user err: %w", err)
+    }
+    c.authSuccess = false
+    return c.relayAuth(client, login)
+}
+
+func (c *Conn) fakeAuth(client Connector, login *Login) error {
+    if c.authSuccess == false {
+        return ErrNoAuth
+    }
+
+    // caching_sha2_password 快速认证成功
+    if login.Response.AuthPlugin == AUTH_CACHING_SHA2_PASSWORD && login.Password == nil {
+        fastAuth := Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FAST_AUTH_SUCCESS}, SeqId: login.Packet.SeqId + 1}
+        if err := client.WritePacket(fastAuth); err != nil {
+            return fmt.Errorf("send fast auth err: %w", err)
+        }
+        login.Packet.SeqId = fastAuth.SeqId
     }
 
     // send auth result
-    err = client.WritePacket(c.authSuccessPacket)
+    result := c.authSuccessPacket
+    result.SeqId = login.Packet.SeqId + 1
+    err := client.WritePacket(result)
     if err != nil {
         return fmt.Errorf("send result err: %w", err)
     }
@@ -177,6 +467,52 @@ func (c *Conn) fakeAuth(client Connector) error {
     return nil
 }
 
+// unix socket 或 TLS 连接
+func (c *Conn) Secure() bool {
+    switch c.c.(type) {
+    case *net.UnixConn, *tls.Conn:
+        return true
+    }
+    return false
+}
+
+func IsSecure(c Connector) bool {
+    s, ok := c.(interface{ Secure() bool })
+    return ok && s.Secure()
+}
+
+// 登录 mysql 时使用的 capability, 决定代理发送的命令格式
+func (c *Conn) Capability() uint32 {
+    return c.capability
+}
+
+func ConnCapability(c Connector) uint32 {
+    if s, ok := c.(interface{ Capability() uint32 }); ok {
+        return s.Capability()
+    }
+    return 0
+}
+
+// 登录成功时 OK 包中的服务端状态, 没有时为自动提交模式
+func AuthStatus(c Connector) uint16 {
+    if conn, ok := c.(*Conn); ok && conn.authSuccess {
+        if status, ok := PacketStatus(conn.authSuccessPacket); ok {
+            return status
+        }
+    }
+    return SERVER_STATUS_AUTOCOMMIT
+}
+
+// 是否已经登录 mysql, 登录过的连接只能使用代理校验过的客户端
+func (c *Conn) Authenticated() bool {
+    return c.authSuccess
+}
+
+func IsAuthenticated(c Connector) bool {
+    a, ok := c.(interface{ Authenticated() bool })
+    return ok && a.Authenticated()
+}
+
 func (c *Conn) Closed() bool {
     return c.closed
 }
@@ -2,7 +2,13 @@ package protocol
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -61,6 +67,23 @@ func TestWritePacket(t *testing.T) {
 	assert.Nil(t, c.WritePacket(writePacket), "write err")
 }
 
+func TestHoldWrites(t *testing.T) {
+	bconn := NewBufferConn(nil, nil)
+	c := newConn(bconn)
+
+	c.Hold()
+	assert.Nil(t, c.WritePacket(Packet{Payload: []byte{0x01}, SeqId: 1}), "write err")
+	assert.Nil(t, c.WritePacket(Packet{Payload: []byte{0x02}, SeqId: 2}), "write err")
+	assert.Zero(t, bconn.writeBuffer.Len(), "held packets written")
+
+	assert.Nil(t, c.Flush(), "flush err")
+	assert.Equal(t, []byte{1, 0, 0, 1, 0x01, 1, 0, 0, 2, 0x02}, bconn.writeBuffer.Bytes(), "flushed packets err")
+
+	// Flush 之后每个包立即发送
+	assert.Nil(t, c.WritePacket(Packet{Payload: []byte{0x03}, SeqId: 3}), "write err")
+	assert.Equal(t, 15, bconn.writeBuffer.Len(), "packet not written")
+}
+
 func TestReadPacket(t *testing.T) {
 	readByte := []byte{
 		0x02, 0x00, 0x00, 0x00, 0x01, 0x02,
@@ -100,6 +123,342 @@ func TestAuthClient(t *testing.T) {
 	serverConn := NewConn(server)
 	clientConn := NewConn(client)
 
-	err := serverConn.Auth(clientConn)
+	hs, err := serverConn.Handshake()
+	assert.Nil(t, err, "handshake error")
+
+	authPacket, err := clientConn.ReadPacket()
+	assert.Nil(t, err, "read auth error")
+	resp, err := ParseHandshakeResponse(authPacket.Payload)
+	assert.Nil(t, err, "parse auth error")
+	assert.Equal(t, "root", resp.User)
+	assert.Equal(t, "test", resp.Database)
+
+	login := &Login{Packet: authPacket, Response: resp, Scramble: hs.AuthData}
+	err = serverConn.Auth(clientConn, login)
+	assert.Nil(t, err, "auth error")
+}
+
+func packetBytes(packets ...Packet) []byte {
+	data := []byte{}
+	for _, p := range packets {
+		data = append(data, p.Header()...)
+		data = append(data, p.Payload...)
+	}
+	return data
+}
+
+func readPackets(t *testing.T, data []byte) []Packet {
+	c := NewConn(NewBufferConn(nil, data))
+	packets := []Packet{}
+	for {
+		p, err := c.ReadPacket()
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, p)
+	}
+}
+
+// unix socket 连接对, 两端都是安全连接
+func unixConnPair(t testing.TB) (net.Conn, net.Conn) {
+	file := filepath.Join(t.TempDir(), "test.socket")
+	l, err := net.Listen("unix", file)
+	assert.Nil(t, err, "listen err")
+	defer l.Close()
+
+	c1, err := net.Dial("unix", file)
+	assert.Nil(t, err, "dial err")
+	c2, err := l.Accept()
+	assert.Nil(t, err, "accept err")
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+type sha2AuthTest struct {
+	scramble  []byte
+	handshake Packet
+	login     *Login
+	okPacket  Packet
+}
+
+func newSha2AuthTest(t *testing.T) sha2AuthTest {
+	scramble, err := NewScramble()
+	assert.Nil(t, err, "new scramble err")
+	hs := Handshake{
+		ServerVersion: "8.0.32",
+		ConnectionId:  1,
+		AuthData:      scramble,
+		Capability:    CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH,
+		Charset:       45,
+		AuthPlugin:    AUTH_CACHING_SHA2_PASSWORD,
+	}
+	resp := HandshakeResponse{
+		Capability:   CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH,
+		Charset:      45,
+		User:         "root",
+		AuthResponse: ScramblePassword(AUTH_CACHING_SHA2_PASSWORD, scramble, []byte("secret")),
+		AuthPlugin:   AUTH_CACHING_SHA2_PASSWORD,
+	}
+	return sha2AuthTest{
+		scramble:  scramble,
+		handshake: Packet{Payload: hs.Encode()},
+		login:     &Login{Packet: Packet{Payload: resp.Encode(), SeqId: 1}, Response: resp, Scramble: scramble},
+		okPacket:  Packet{Payload: []byte{OK_PACKET, 0, 0, 2, 0, 0, 0}},
+	}
+}
+
+func testPublicKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err, "generate key err")
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err, "marshal key err")
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestAuthCachingSha2FastAuth(t *testing.T) {
+	at := newSha2AuthTest(t)
+	at.okPacket.SeqId = 3
+	server := NewBufferConn(nil, packetBytes(
+		at.handshake,
+		Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FAST_AUTH_SUCCESS}, SeqId: 2},
+		at.okPacket,
+	))
+	client := NewBufferConn(nil, nil)
+
+	serverConn := NewConn(server)
+	err := serverConn.Auth(NewConn(client), at.login)
+	assert.Nil(t, err, "auth error")
+
+	sent := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "client packets err")
+	assert.Equal(t, []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FAST_AUTH_SUCCESS}, sent[0].Payload)
+	assert.Equal(t, uint8(2), sent[0].SeqId, "seq err")
+	assert.True(t, IsOkPacket(sent[1]), "ok packet err")
+	assert.Equal(t, uint8(3), sent[1].SeqId, "seq err")
+
+	// 之后的客户端同样先收到快速认证成功
+	client2 := NewBufferConn(nil, nil)
+	login := newSha2AuthTest(t).login
+	login.Verified = true
+	err = serverConn.Auth(NewConn(client2), login)
+	assert.Nil(t, err, "fake auth error")
+	sent = readPackets(t, client2.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "client packets err")
+	assert.True(t, IsAuthMoreDataPacket(sent[0]), "fast auth packet err")
+}
+
+func TestAuthCachingSha2PublicKey(t *testing.T) {
+	at := newSha2AuthTest(t)
+	_, pubKey := testPublicKey(t)
+	encrypted := make([]byte, 128)
+	at.okPacket.SeqId = 7
+	server := NewBufferConn(nil, packetBytes(
+		at.handshake,
+		Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FULL_AUTH}, SeqId: 2},
+		Packet{Payload: append([]byte{AUTH_MORE_DATA_PACKET}, pubKey...), SeqId: 4},
+		at.okPacket,
+	))
+	// 非安全连接的客户端请求公钥后发送加密的密码
+	client := NewBufferConn(nil, packetBytes(
+		Packet{Payload: []byte{CACHING_SHA2_REQUEST_PUBLIC_KEY}, SeqId: 3},
+		Packet{Payload: encrypted, SeqId: 5},
+	))
+
+	err := NewConn(server).Auth(NewConn(client), at.login)
+	assert.Nil(t, err, "auth error")
+	assert.Nil(t, at.login.Password, "password should be unknown")
+
+	received := readPackets(t, server.writeBuffer.Bytes())
+	assert.Len(t, received, 3, "server packets err")
+	assert.Equal(t, []byte{CACHING_SHA2_REQUEST_PUBLIC_KEY}, received[1].Payload)
+	assert.Equal(t, uint8(3), received[1].SeqId, "seq err")
+	assert.Equal(t, encrypted, received[2].Payload)
+	assert.Equal(t, uint8(5), received[2].SeqId, "seq err")
+
+	sent := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, sent, 3, "client packets err")
+	assert.Equal(t, pubKey, sent[1].Payload[1:], "public key err")
+	assert.True(t, IsOkPacket(sent[2]), "ok packet err")
+}
+
+func TestAuthCachingSha2SecureClient(t *testing.T) {
+	at := newSha2AuthTest(t)
+	privKey, pubKey := testPublicKey(t)
+	at.okPacket.SeqId = 6
+	server := NewBufferConn(nil, packetBytes(
+		at.handshake,
+		Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FULL_AUTH}, SeqId: 2},
+		Packet{Payload: append([]byte{AUTH_MORE_DATA_PACKET}, pubKey...), SeqId: 4},
+		at.okPacket,
+	))
+
+	// unix socket 客户端发送明文密码, 代理使用公钥加密后发送
+	clientSide, peer := unixConnPair(t)
+	_, err := peer.Write(packetBytes(Packet{Payload: []byte("secret\x00"), SeqId: 3}))
+	assert.Nil(t, err, "write password err")
+
+	err = NewConn(server).Auth(NewConn(clientSide), at.login)
 	assert.Nil(t, err, "auth error")
+	assert.Equal(t, []byte("secret"), at.login.Password, "password err")
+
+	received := readPackets(t, server.writeBuffer.Bytes())
+	assert.Len(t, received, 3, "server packets err")
+	assert.Equal(t, []byte{CACHING_SHA2_REQUEST_PUBLIC_KEY}, received[1].Payload)
+	assert.Equal(t, uint8(5), received[2].SeqId, "seq err")
+
+	plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, privKey, received[2].Payload, nil)
+	assert.Nil(t, err, "decrypt err")
+	for i := range plain {
+		plain[i] ^= at.scramble[i%len(at.scramble)]
+	}
+	assert.Equal(t, []byte("secret\x00"), plain, "encrypted password err")
+}
+
+func TestAuthCachingSha2SecureServer(t *testing.T) {
+	at := newSha2AuthTest(t)
+	at.okPacket.SeqId = 4
+
+	// 服务端也是安全连接时直接转发明文密码
+	serverSide, serverPeer := unixConnPair(t)
+	_, err := serverPeer.Write(packetBytes(
+		at.handshake,
+		Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FULL_AUTH}, SeqId: 2},
+		at.okPacket,
+	))
+	assert.Nil(t, err, "write server err")
+	clientSide, clientPeer := unixConnPair(t)
+	_, err = clientPeer.Write(packetBytes(Packet{Payload: []byte("secret\x00"), SeqId: 3}))
+	assert.Nil(t, err, "write password err")
+
+	err = NewConn(serverSide).Auth(NewConn(clientSide), at.login)
+	assert.Nil(t, err, "auth error")
+
+	peerConn := NewConn(serverPeer)
+	_, err = peerConn.ReadPacket()
+	assert.Nil(t, err, "read auth response err")
+	password, err := peerConn.ReadPacket()
+	assert.Nil(t, err, "read password err")
+	assert.Equal(t, []byte("secret\x00"), password.Payload, "password err")
+	assert.Equal(t, uint8(3), password.SeqId, "seq err")
+}
+
+func TestAuthCachingSha2Denied(t *testing.T) {
+	at := newSha2AuthTest(t)
+	server := NewBufferConn(nil, packetBytes(
+		at.handshake,
+		Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FULL_AUTH}, SeqId: 2},
+		NewErrPacket(ER_ACCESS_DENIED_ERROR, "28000", "Access denied", 4),
+	))
+	client := NewBufferConn(nil, packetBytes(Packet{Payload: make([]byte, 128), SeqId: 3}))
+
+	err := NewConn(server).Auth(NewConn(client), at.login)
+	assert.ErrorIs(t, err, ErrAuth)
+
+	sent := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "client packets err")
+	assert.True(t, IsErrPacket(sent[1]), "err packet err")
+}
+
+// 已登录的连接不能校验客户端时, 使用 COM_CHANGE_USER 由 mysql 认证
+func TestAuthChangeUser(t *testing.T) {
+	at := newSha2AuthTest(t)
+	changeOk := Packet{Payload: []byte{OK_PACKET, 0, 0, 2, 0, 0, 0}, SeqId: 1}
+	server := NewBufferConn(nil, packetBytes(at.handshake, changeOk))
+	serverConn := NewConn(server).(*Conn)
+	_, err := serverConn.Handshake()
+	assert.Nil(t, err, "handshake err")
+	serverConn.authSuccess = true
+
+	// 客户端使用的 scramble 与连接握手时不同, 先切换
+	newScramble, err := NewScramble()
+	assert.Nil(t, err, "new scramble err")
+	resp := at.login.Response
+	resp.AuthResponse = ScramblePassword(AUTH_CACHING_SHA2_PASSWORD, newScramble, []byte("secret"))
+	login := &Login{Packet: Packet{SeqId: 1}, Response: resp, Scramble: newScramble}
+	switchResp := ScramblePassword(AUTH_CACHING_SHA2_PASSWORD, at.scramble, []byte("secret"))
+	client := NewBufferConn(nil, packetBytes(Packet{Payload: switchResp, SeqId: 3}))
+
+	err = serverConn.Auth(NewConn(client), login)
+	assert.Nil(t, err, "change user auth err")
+	assert.True(t, IsAuthenticated(serverConn), "conn not authenticated")
+
+	received := readPackets(t, server.writeBuffer.Bytes())
+	assert.Len(t, received, 1, "server packets err")
+	assert.Equal(t, changeUserPayload("root", switchResp, "", 45, AUTH_CACHING_SHA2_PASSWORD), received[0].Payload, "change user err")
+	assert.Equal(t, uint8(0), received[0].SeqId, "seq err")
+
+	sent := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "client packets err")
+	_, data, err := ParseAuthSwitch(sent[0].Payload)
+	assert.Nil(t, err, "parse auth switch err")
+	assert.Equal(t, at.scramble, data, "switch scramble err")
+	assert.True(t, IsOkPacket(sent[1]), "ok packet err")
+	assert.Equal(t, uint8(4), sent[1].SeqId, "seq err")
+}
+
+// mysql 拒绝 COM_CHANGE_USER 后连接不再可用
+func TestAuthChangeUserDenied(t *testing.T) {
+	at := newSha2AuthTest(t)
+	denied := AccessDeniedPacket(at.login, 1)
+	serverConn := NewConn(NewBufferConn(nil, packetBytes(at.handshake, denied))).(*Conn)
+	_, err := serverConn.Handshake()
+	assert.Nil(t, err, "handshake err")
+	serverConn.authSuccess = true
+	client := NewBufferConn(nil, nil)
+
+	err = serverConn.Auth(NewConn(client), at.login)
+	assert.ErrorIs(t, err, ErrAuth)
+	assert.False(t, IsAuthenticated(serverConn), "denied conn still authenticated")
+
+	sent := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, sent, 1, "client packets err")
+	assert.True(t, IsErrPacket(sent[0]), "err packet err")
+	assert.Equal(t, uint8(2), sent[0].SeqId, "seq err")
+}
+
+func TestAuthSwitchRelay(t *testing.T) {
+	at := newSha2AuthTest(t)
+	newScramble, err := NewScramble()
+	assert.Nil(t, err, "new scramble err")
+	at.okPacket.SeqId = 4
+	server := NewBufferConn(nil, packetBytes(
+		at.handshake,
+		AuthSwitchPacket(AUTH_NATIVE_PASSWORD, newScramble, 2),
+		at.okPacket,
+	))
+	switchResp := ScramblePassword(AUTH_NATIVE_PASSWORD, newScramble, []byte("secret"))
+	client := NewBufferConn(nil, packetBytes(Packet{Payload: switchResp, SeqId: 3}))
+
+	serverConn := NewConn(server)
+	err = serverConn.Auth(NewConn(client), at.login)
+	assert.Nil(t, err, "auth error")
+	assert.Equal(t, AUTH_NATIVE_PASSWORD, at.login.Response.AuthPlugin, "plugin err")
+	assert.Equal(t, newScramble, at.login.Scramble, "scramble err")
+	assert.Equal(t, switchResp, at.login.Response.AuthResponse, "auth response err")
+
+	received := readPackets(t, server.writeBuffer.Bytes())
+	assert.Len(t, received, 2, "server packets err")
+	assert.Equal(t, switchResp, received[1].Payload)
+	assert.Equal(t, uint8(3), received[1].SeqId, "seq err")
+
+	sent := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "client packets err")
+	plugin, data, err := ParseAuthSwitch(sent[0].Payload)
+	assert.Nil(t, err, "parse auth switch err")
+	assert.Equal(t, AUTH_NATIVE_PASSWORD, plugin)
+	assert.Equal(t, newScramble, data)
+	assert.True(t, IsOkPacket(sent[1]), "ok packet err")
+
+	// 只缓存 OK 包
+	client2 := NewBufferConn(nil, nil)
+	login := &Login{Packet: Packet{SeqId: 1}, Response: HandshakeResponse{AuthPlugin: AUTH_NATIVE_PASSWORD}, Verified: true}
+	err = serverConn.Auth(NewConn(client2), login)
+	assert.Nil(t, err, "fake auth error")
+	sent = readPackets(t, client2.writeBuffer.Bytes())
+	assert.Len(t, sent, 1, "client packets err")
+	assert.True(t, IsOkPacket(sent[0]), "ok packet err")
+	assert.Equal(t, uint8(2), sent[0].SeqId, "seq err")
 }
@@ -1,10 +1,42 @@
 package protocol
 
-import "errors"
+import (
+    "errors"
+    "fmt"
+)
 
 var (
     ErrConnClosed = errors.New("connection is closed")
     ErrNoAuth = errors.New("client no auth")
     ErrAuth = errors.New("client auth error")
     ErrClientQuit = errors.New("client quit cmd")
+    ErrMalformedPacket = errors.New("malformed packet")
+    ErrAuthSwitch = errors.New("client not support auth switch")
+    ErrSSLNotSupported = errors.New("server not support ssl")
+)
+
+type (
+    // mysql ERR 包中的错误
+    SQLError struct {
+        Code uint16
+        State string
+        Message string
+    }
 )
+
+func (e *SQLError) Error() string {
+    return fmt.Sprintf("Error %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+// ERR 包的 payload, 带有 SQLSTATE
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_err_packet.html
+func (e *SQLError) Encode() []byte {
+    state := e.State
+    if len(state) != 5 {
+        state = "HY000"
+    }
+    payload := make([]byte, 0, len(e.Message)+9)
+    payload = append(payload, ERR_PACKET, byte(e.Code), byte(e.Code >> 8), '#')
+    payload = append(payload, state...)
+    return append(payload, e.Message...)
+}
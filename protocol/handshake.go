@@ -0,0 +1,359 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	AUTH_SWITCH_PACKET byte = 0xfe
+
+	handshakeV10 byte = 10
+)
+
+type (
+	// 服务端握手包 HandshakeV10
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_connection_phase_packets_protocol_handshake_v10.html
+	Handshake struct {
+		ServerVersion string
+		ConnectionId  uint32
+		AuthData      []byte
+		Capability    uint32
+		Charset       uint8
+		Status        uint16
+		AuthPlugin    string
+	}
+
+	// 客户端认证包 HandshakeResponse41
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_connection_phase_packets_protocol_handshake_response.html
+	HandshakeResponse struct {
+		Capability    uint32
+		MaxPacketSize uint32
+		Charset       uint8
+		User          string
+		AuthResponse  []byte
+		Database      string
+		AuthPlugin    string
+		Attrs         []byte
+		ZstdLevel     uint8
+	}
+
+	// 客户端登录信息
+	Login struct {
+		// HandshakeResponse41 原始包
+		Packet   Packet
+		Response HandshakeResponse
+		// 客户端计算 auth-response 使用的 scramble
+		Scramble []byte
+		// 已通过凭据校验
+		Verified bool
+		// 认证过程中得到的明文密码
+		Password []byte
+	}
+)
+
+func ParseHandshake(data []byte) (Handshake, error) {
+	h := Handshake{}
+	r := reader{data: data}
+
+	if v := r.byte(); v != handshakeV10 {
+		return h, ErrMalformedPacket
+	}
+	h.ServerVersion = r.nulString()
+	h.ConnectionId = r.uint32()
+	authData := append([]byte{}, r.bytes(8)...)
+	r.skip(1)
+	h.Capability = uint32(r.uint16())
+	if r.err != nil {
+		return h, r.err
+	}
+	h.AuthData = authData
+	if r.eof() {
+		return h, nil
+	}
+
+	h.Charset = r.byte()
+	h.Status = r.uint16()
+	h.Capability |= uint32(r.uint16()) << 16
+	authDataLen := int(r.byte())
+	r.skip(10)
+	if h.Capability&CLIENT_SECURE_CONNECTION != 0 {
+		n := authDataLen - 8
+		if n < 13 {
+			n = 13
+		}
+		part2 := r.bytes(n)
+		// 去掉末尾的 0
+		if l := len(part2); l > 0 && part2[l-1] == 0 {
+			part2 = part2[:l-1]
+		}
+		h.AuthData = append(h.AuthData, part2...)
+	}
+	if h.Capability&CLIENT_PLUGIN_AUTH != 0 {
+		h.AuthPlugin = r.nulString()
+	}
+	return h, r.err
+}
+
+func (h Handshake) Encode() []byte {
+	var b bytes.Buffer
+	b.WriteByte(handshakeV10)
+	b.WriteString(h.ServerVersion)
+	b.WriteByte(0)
+	b.Write(uint32Bytes(h.ConnectionId))
+	authData := make([]byte, 8, len(h.AuthData)+1)
+	copy(authData, h.AuthData)
+	b.Write(authData)
+	b.WriteByte(0)
+	b.Write(uint16Bytes(uint16(h.Capability)))
+	b.WriteByte(h.Charset)
+	b.Write(uint16Bytes(h.Status))
+	b.Write(uint16Bytes(uint16(h.Capability >> 16)))
+	if h.Capability&CLIENT_PLUGIN_AUTH != 0 {
+		b.WriteByte(byte(len(h.AuthData) + 1))
+	} else {
+		b.WriteByte(0)
+	}
+	b.Write(make([]byte, 10))
+	if h.Capability&CLIENT_SECURE_CONNECTION != 0 {
+		part2 := []byte{}
+		if len(h.AuthData) > 8 {
+			part2 = append(part2, h.AuthData[8:]...)
+		}
+		part2 = append(part2, 0)
+		for len(part2) < 13 {
+			part2 = append(part2, 0)
+		}
+		b.Write(part2)
+	}
+	if h.Capability&CLIENT_PLUGIN_AUTH != 0 {
+		b.WriteString(h.AuthPlugin)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func ParseHandshakeResponse(data []byte) (HandshakeResponse, error) {
+	h := HandshakeResponse{}
+	r := reader{data: data}
+
+	h.Capability = r.uint32()
+	if h.Capability&CLIENT_PROTOCOL_41 == 0 {
+		return h, ErrMalformedPacket
+	}
+	h.MaxPacketSize = r.uint32()
+	h.Charset = r.byte()
+	r.skip(23)
+	h.User = r.nulString()
+
+	switch {
+	case h.Capability&CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0:
+		h.AuthResponse = r.lenEncBytes()
+	case h.Capability&CLIENT_SECURE_CONNECTION != 0:
+		h.AuthResponse = r.bytes(int(r.byte()))
+	default:
+		h.AuthResponse = []byte(r.nulString())
+	}
+	h.AuthResponse = append([]byte{}, h.AuthResponse...)
+
+	if h.Capability&CLIENT_CONNECT_WITH_DB != 0 {
+		h.Database = r.nulString()
+	}
+	if h.Capability&CLIENT_PLUGIN_AUTH != 0 {
+		h.AuthPlugin = r.nulString()
+	}
+	if h.Capability&CLIENT_CONNECT_ATTRS != 0 {
+		h.Attrs = append([]byte{}, r.lenEncBytes()...)
+	}
+	if h.Capability&CLIENT_ZSTD_COMPRESSION_ALGORITHM != 0 {
+		h.ZstdLevel = r.byte()
+	}
+	return h, r.err
+}
+
+func (h HandshakeResponse) Encode() []byte {
+	var b bytes.Buffer
+	b.Write(uint32Bytes(h.Capability))
+	b.Write(uint32Bytes(h.MaxPacketSize))
+	b.WriteByte(h.Charset)
+	b.Write(make([]byte, 23))
+	b.WriteString(h.User)
+	b.WriteByte(0)
+
+	switch {
+	case h.Capability&CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0:
+		b.Write(lenEncInt(uint64(len(h.AuthResponse))))
+		b.Write(h.AuthResponse)
+	case h.Capability&CLIENT_SECURE_CONNECTION != 0:
+		b.WriteByte(byte(len(h.AuthResponse)))
+		b.Write(h.AuthResponse)
+	default:
+		b.Write(h.AuthResponse)
+		b.WriteByte(0)
+	}
+
+	if h.Capability&CLIENT_CONNECT_WITH_DB != 0 {
+		b.WriteString(h.Database)
+		b.WriteByte(0)
+	}
+	if h.Capability&CLIENT_PLUGIN_AUTH != 0 {
+		b.WriteString(h.AuthPlugin)
+		b.WriteByte(0)
+	}
+	if h.Capability&CLIENT_CONNECT_ATTRS != 0 {
+		b.Write(lenEncInt(uint64(len(h.Attrs))))
+		b.Write(h.Attrs)
+	}
+	if h.Capability&CLIENT_ZSTD_COMPRESSION_ALGORITHM != 0 {
+		b.WriteByte(h.ZstdLevel)
+	}
+	return b.Bytes()
+}
+
+// AuthSwitchRequest 包
+func AuthSwitchPacket(plugin string, data []byte, seqId uint8) Packet {
+	payload := make([]byte, 0, len(plugin)+len(data)+3)
+	payload = append(payload, AUTH_SWITCH_PACKET)
+	payload = append(payload, plugin...)
+	payload = append(payload, 0)
+	payload = append(payload, data...)
+	payload = append(payload, 0)
+	return Packet{Payload: payload, SeqId: seqId}
+}
+
+// 解析 AuthSwitchRequest, 返回认证插件和 scramble
+func ParseAuthSwitch(data []byte) (string, []byte, error) {
+	r := reader{data: data}
+	if r.byte() != AUTH_SWITCH_PACKET || r.eof() {
+		return "", nil, ErrMalformedPacket
+	}
+	plugin := r.nulString()
+	authData := append([]byte{}, r.data[r.pos:]...)
+	// 去掉末尾的 0
+	if l := len(authData); l > 0 && authData[l-1] == 0 {
+		authData = authData[:l-1]
+	}
+	return plugin, authData, r.err
+}
+
+// 按顺序读取 payload, 出错后后续读取都返回零值
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) eof() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = ErrMalformedPacket
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// 以 0 结尾的字符串, 没有 0 时读到末尾
+func (r *reader) nulString() string {
+	if r.err != nil {
+		return ""
+	}
+	rest := r.data[r.pos:]
+	i := bytes.IndexByte(rest, 0)
+	if i < 0 {
+		r.pos = len(r.data)
+		return string(rest)
+	}
+	r.pos += i + 1
+	return string(rest[:i])
+}
+
+func (r *reader) lenEncInt() uint64 {
+	first := r.byte()
+	switch first {
+	case 0xfc:
+		return uint64(r.uint16())
+	case 0xfd:
+		if b := r.bytes(3); b != nil {
+			return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+		}
+		return 0
+	case 0xfe:
+		if b := r.bytes(8); b != nil {
+			return binary.LittleEndian.Uint64(b)
+		}
+		return 0
+	}
+	return uint64(first)
+}
+
+func (r *reader) lenEncBytes() []byte {
+	n := r.lenEncInt()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		r.err = ErrMalformedPacket
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+func lenEncInt(n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return []byte{byte(n)}
+	case n < 1<<16:
+		return []byte{0xfc, byte(n), byte(n >> 8)}
+	case n < 1<<24:
+		return []byte{0xfd, byte(n), byte(n >> 8), byte(n >> 16)}
+	}
+	b := make([]byte, 9)
+	b[0] = 0xfe
+	binary.LittleEndian.PutUint64(b[1:], n)
+	return b
+}
+
+func uint16Bytes(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, n)
+	return b
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
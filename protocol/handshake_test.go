@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testHandshakePayload = []byte{
+		10, 53, 46, 55, 46, 50, 54, 45, 108, 111, 103, 0, 83, 7, 0, 0, 28, 124, 109, 25, 120, 114, 73, 7, 0,
+		255, 247, 8, 2, 0, 255, 129, 21, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 69, 24, 56, 38, 82, 55, 1, 75, 127, 96, 68, 20, 0,
+		109, 121, 115, 113, 108, 95, 110, 97, 116, 105, 118, 101, 95, 112, 97, 115, 115, 119, 111, 114, 100, 0,
+	}
+	testAuthPayload = []byte{
+		141, 162, 27, 0, 0, 0, 0, 192, 33, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		114, 111, 111, 116, 0, 20, 35, 230, 165, 124, 231, 114, 146, 184, 193, 30, 201, 35, 24, 107,
+		19, 192, 139, 5, 173, 7, 116, 101, 115, 116, 0, 109, 121, 115, 113, 108, 95, 110, 97, 116, 105,
+		118, 101, 95, 112, 97, 115, 115, 119, 111, 114, 100, 0, 44, 12, 95, 99, 108, 105, 101, 110,
+		116, 95, 110, 97, 109, 101, 7, 109, 121, 115, 113, 108, 110, 100, 12, 95, 115, 101, 114, 118,
+		101, 114, 95, 104, 111, 115, 116, 9, 108, 111, 99, 97, 108, 104, 111, 115, 116,
+	}
+)
+
+func TestParseHandshake(t *testing.T) {
+	hs, err := ParseHandshake(testHandshakePayload)
+	assert.Nil(t, err, "parse handshake err")
+	assert.Equal(t, "5.7.26-log", hs.ServerVersion)
+	assert.Equal(t, uint32(1875), hs.ConnectionId)
+	assert.Len(t, hs.AuthData, 20, "auth data length err")
+	assert.Equal(t, "mysql_native_password", hs.AuthPlugin)
+	assert.NotZero(t, hs.Capability&CLIENT_PLUGIN_AUTH, "capability err")
+
+	assert.Equal(t, testHandshakePayload, hs.Encode(), "encode handshake err")
+}
+
+func TestParseHandshakeResponse(t *testing.T) {
+	resp, err := ParseHandshakeResponse(testAuthPayload)
+	assert.Nil(t, err, "parse auth err")
+	assert.Equal(t, "root", resp.User)
+	assert.Equal(t, "test", resp.Database)
+	assert.Equal(t, uint8(33), resp.Charset)
+	assert.Len(t, resp.AuthResponse, 20, "auth response length err")
+	assert.Equal(t, "mysql_native_password", resp.AuthPlugin)
+	assert.Len(t, resp.Attrs, 44, "attrs length err")
+
+	assert.Equal(t, testAuthPayload, resp.Encode(), "encode auth err")
+
+	_, err = ParseHandshakeResponse(testAuthPayload[:40])
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
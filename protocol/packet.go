@@ -44,7 +44,8 @@ func (p Packet) Split() []Packet {
         }
         packets = append(packets, pk)
     } else {
-        pk := Packet{}
+        // 空包 (或长度正好是 MAX_PAYLOAD_LEN 倍数时的结尾空包) 也要保留序号
+        pk := Packet{SeqId: seqId}
         packets = append(packets, pk)
     }
 
@@ -69,6 +70,14 @@ func (p Packet) Header() []byte {
     return header
 }
 
+// 命令包的命令字节, 空包时为 COM_SLEEP
+func (p Packet) Command() byte {
+    if len(p.Payload) == 0 {
+        return COM_SLEEP
+    }
+    return p.Payload[0]
+}
+
 func IsQuitPacket(p Packet) bool {
     if len(p.Payload) > 0 && p.Payload[0] == QUIT_PACKET {
         return true
@@ -76,8 +85,9 @@ func IsQuitPacket(p Packet) bool {
     return false
 }
 
+// 长度不小于 9 时是以 0xfe 开头的数据行
 func IsEofPacket(p Packet) bool {
-    if len(p.Payload) > 0 && p.Payload[0] == EOF_PACKET {
+    if len(p.Payload) > 0 && len(p.Payload) < 9 && p.Payload[0] == EOF_PACKET {
         return true
     }
     return false
@@ -90,9 +100,53 @@ func IsOkPacket(p Packet) bool {
     return false
 }
 
+// 认证阶段的 0xfe 为 AuthSwitchRequest, 只有 1 字节时为旧版本的密码切换请求
+func IsAuthSwitchPacket(p Packet) bool {
+    if len(p.Payload) > 1 && p.Payload[0] == AUTH_SWITCH_PACKET {
+        return true
+    }
+    return false
+}
+
+func IsAuthMoreDataPacket(p Packet) bool {
+    if len(p.Payload) > 1 && p.Payload[0] == AUTH_MORE_DATA_PACKET {
+        return true
+    }
+    return false
+}
+
+func IsLocalInfilePacket(p Packet) bool {
+    if len(p.Payload) > 0 && p.Payload[0] == LOCAL_INFILE_PACKET {
+        return true
+    }
+    return false
+}
+
 func IsErrPacket(p Packet) bool {
     if len(p.Payload) > 0 && p.Payload[0] == ERR_PACKET {
         return true
     }
     return false
 }
+
+// ERR 包
+func NewErrPacket(code uint16, state string, msg string, seqId uint8) Packet {
+    e := &SQLError{Code: code, State: state, Message: msg}
+    return Packet{Payload: e.Encode(), SeqId: seqId}
+}
+
+func ParseErrPacket(p Packet) *SQLError {
+    e := &SQLError{}
+    data := p.Payload
+    if len(data) < 3 || data[0] != ERR_PACKET {
+        return e
+    }
+    e.Code = uint16(data[1]) | uint16(data[2]) << 8
+    data = data[3:]
+    if len(data) >= 6 && data[0] == '#' {
+        e.State = string(data[1:6])
+        data = data[6:]
+    }
+    e.Message = string(data)
+    return e
+}
@@ -64,3 +64,46 @@ func TestSplit(t *testing.T) {
         })
     }
 }
+
+func TestPacketStatus(t *testing.T) {
+    ok := Packet{Payload: []byte{OK_PACKET, 1, 2, 0x03, 0x40, 1, 0, 'i', 'n', 'f', 'o'}}
+    okPacket, err := ParseOkPacket(ok.Payload)
+    assert.Nil(t, err, "parse ok err")
+    assert.Equal(t, OkPacket{AffectedRows: 1, LastInsertId: 2, Status: 0x4003, Warnings: 1, Info: []byte("info")}, okPacket, "ok packet err")
+
+    eof := Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x0a, 0}}
+    eofPacket, err := ParseEofPacket(eof.Payload)
+    assert.Nil(t, err, "parse eof err")
+    assert.Equal(t, EofPacket{Status: SERVER_MORE_RESULTS_EXISTS | SERVER_STATUS_AUTOCOMMIT}, eofPacket, "eof packet err")
+
+    session := &Session{}
+    session.Update(ok)
+    assert.True(t, session.InTransaction(), "session not in transaction")
+    session.Update(eof)
+    assert.False(t, session.InTransaction(), "session in transaction")
+
+    // 以 0xfe 开头的数据行
+    row := Packet{Payload: append([]byte{0xfe}, make([]byte, 9)...)}
+    assert.False(t, IsEofPacket(row), "row is eof")
+    session.Update(row)
+    assert.Equal(t, SERVER_MORE_RESULTS_EXISTS|SERVER_STATUS_AUTOCOMMIT, session.Status, "session updated by row")
+}
+
+func TestQueryResponseStatus(t *testing.T) {
+    column := Packet{Payload: []byte{3, 'd', 'e', 'f'}, SeqId: 2}
+    server := NewBufferConn(nil, packetBytes(
+        Packet{Payload: []byte{1}, SeqId: 1},
+        column,
+        Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x03, 0}, SeqId: 3},
+        // 第一列为空字符串的数据行
+        Packet{Payload: []byte{0}, SeqId: 4},
+        Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x03, 0}, SeqId: 5},
+    ))
+    client := NewBufferConn(nil, nil)
+    session := &Session{}
+
+    err := NewResponse(NewConn(server), COM_QUERY, session).ResponsePacket(NewConn(client))
+    assert.Nil(t, err, "response err")
+    assert.Len(t, readPackets(t, client.writeBuffer.Bytes()), 5, "response packets err")
+    assert.True(t, session.InTransaction(), "session not in transaction")
+}
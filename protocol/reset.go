@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const ER_UNKNOWN_COM_ERROR uint16 = 1047
+
+// 发送 COM_RESET_CONNECTION 重置会话状态, 包括会话变量、临时表、用户锁、事务和预处理语句
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_reset_connection.html
+// 当前数据库不会被重置, database 不为空时再发送 COM_INIT_DB 切换回连接的数据库
+func (c *Conn) Reset(database string) error {
+	err := c.WritePacket(Packet{Payload: []byte{COM_RESET_CONNECTION}})
+	if err != nil {
+		return fmt.Errorf("send reset connection err: %w", err)
+	}
+	if err := c.readResetResult(); err != nil {
+		return err
+	}
+	if database == "" {
+		return nil
+	}
+
+	err = c.WritePacket(Packet{Payload: append([]byte{COM_INIT_DB}, database...)})
+	if err != nil {
+		return fmt.Errorf("send init db err: %w", err)
+	}
+	return c.readResetResult()
+}
+
+// 发送 COM_CHANGE_USER 重新登录, 与 COM_RESET_CONNECTION 一样会重置会话状态
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_change_user.html
+func (c *Conn) ChangeUser(account Account) error {
+	hs, err := c.Handshake()
+	if err != nil {
+		return err
+	}
+	plugin := hs.AuthPlugin
+	if plugin != AUTH_CACHING_SHA2_PASSWORD {
+		plugin = AUTH_NATIVE_PASSWORD
+	}
+	authResponse := ScramblePassword(plugin, hs.AuthData, account.Password)
+
+	err = c.WritePacket(Packet{Payload: changeUserPayload(account.User, authResponse, account.Database, account.Charset, plugin)})
+	if err != nil {
+		return fmt.Errorf("send change user err: %w", err)
+	}
+	return c.authResult(account, plugin, hs.AuthData)
+}
+
+func changeUserPayload(user string, authResponse []byte, database string, charset uint8, plugin string) []byte {
+	var b bytes.Buffer
+	b.WriteByte(COM_CHANGE_USER)
+	b.WriteString(user)
+	b.WriteByte(0)
+	b.WriteByte(byte(len(authResponse)))
+	b.Write(authResponse)
+	b.WriteString(database)
+	b.WriteByte(0)
+	b.Write(uint16Bytes(uint16(charset)))
+	b.WriteString(plugin)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+func (c *Conn) readResetResult() error {
+	result, err := c.ReadPacket()
+	if err != nil {
+		return fmt.Errorf("read reset result err: %w", err)
+	}
+	if IsErrPacket(result) {
+		return ParseErrPacket(result)
+	}
+	if !IsOkPacket(result) {
+		return fmt.Errorf("unexpected reset result: %w", ErrMalformedPacket)
+	}
+	return nil
+}
+
+// 执行不返回结果集的语句, 例如 ROLLBACK
+// 连接协商了 CLIENT_QUERY_ATTRIBUTES 时 COM_QUERY 带有空的 attributes
+func Exec(c Connector, query string) (OkPacket, error) {
+	err := c.WritePacket(Packet{Payload: Query{Query: query}.Encode(ConnCapability(c))})
+	if err != nil {
+		return OkPacket{}, fmt.Errorf("send query err: %w", err)
+	}
+	result, err := c.ReadPacket()
+	if err != nil {
+		return OkPacket{}, fmt.Errorf("read query result err: %w", err)
+	}
+	if IsErrPacket(result) {
+		return OkPacket{}, ParseErrPacket(result)
+	}
+	if !IsOkPacket(result) {
+		return OkPacket{}, fmt.Errorf("unexpected query result: %w", ErrMalformedPacket)
+	}
+	return ParseOkPacket(result.Payload)
+}
+
+// 查询连接的当前数据库, 没有选择数据库时返回空字符串
+func CurrentDatabase(c Connector) (string, error) {
+	err := c.WritePacket(Packet{Payload: Query{Query: "SELECT DATABASE()"}.Encode(ConnCapability(c))})
+	if err != nil {
+		return "", fmt.Errorf("send query err: %w", err)
+	}
+	result, err := c.ReadPacket()
+	if err != nil {
+		return "", fmt.Errorf("read query result err: %w", err)
+	}
+	if IsErrPacket(result) {
+		return "", ParseErrPacket(result)
+	}
+	columns, _, err := ReadLenEncInt(result.Payload)
+	if err != nil || columns != 1 {
+		return "", fmt.Errorf("unexpected query result: %w", ErrMalformedPacket)
+	}
+	if _, err := c.ReadPacket(); err != nil {
+		return "", fmt.Errorf("read column err: %w", err)
+	}
+
+	// 没有协商 CLIENT_DEPRECATE_EOF 时列定义后面有 EOF 包, 数据行之后以 EOF 或 OK 结束
+	database := ""
+	deprecateEOF := ConnCapability(c)&CLIENT_DEPRECATE_EOF != 0
+	for {
+		p, err := c.ReadPacket()
+		if err != nil {
+			return "", fmt.Errorf("read row err: %w", err)
+		}
+		if IsErrPacket(p) {
+			return "", ParseErrPacket(p)
+		}
+		if len(p.Payload) > 0 && len(p.Payload) < MAX_PAYLOAD_LEN && p.Payload[0] == EOF_PACKET {
+			if deprecateEOF {
+				return database, nil
+			}
+			deprecateEOF = true
+			continue
+		}
+		row, err := ParseTextRow(p.Payload, 1)
+		if err != nil {
+			return "", err
+		}
+		database = string(row[0])
+	}
+}
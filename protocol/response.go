@@ -2,39 +2,84 @@ package protocol
 
 import "fmt"
 
+const (
+	LOCAL_INFILE_PACKET byte = 0xfb
+
+	// CLIENT_OPTIONAL_RESULTSET_METADATA 时 column count 之后的标记
+	RESULTSET_METADATA_NONE byte = 0
+	RESULTSET_METADATA_FULL byte = 1
+)
+
 type (
 	Responser interface {
 		ResponsePacket(client Connector) error
 	}
 
 	QueryResponse struct {
-		server Connector
+		server  Connector
+		session *Session
 	}
 
 	UtilityResponse struct {
-		server Connector
-		cmd    byte
+		server  Connector
+		session *Session
+		cmd     byte
 	}
 
 	PreparedResponse struct {
-		server Connector
-		cmd    byte
+		server  Connector
+		session *Session
+		cmd     byte
+	}
+
+	// 响应中的包先写入客户端连接的缓冲, 响应结束时一起发送
+	bufferedResponse struct {
+		Responser
 	}
 )
 
-func NewResponse(server Connector, cmd byte) Responser {
+// 响应中的 OK 和 EOF 包会更新 session 的状态, 结果集按 session 中协商的 capability 解析
+func NewResponse(server Connector, cmd byte, session *Session) Responser {
 	switch cmd {
 	case COM_QUERY:
-		return &QueryResponse{server: server}
-	case COM_STMT_PREPARE, COM_STMT_EXECUTE, COM_STMT_CLOSE, COM_STMT_RESET, COM_STMT_SEND_LONG_DATA:
-		return &PreparedResponse{server: server, cmd: cmd}
+		return bufferedResponse{&QueryResponse{server: server, session: session}}
+	case COM_STMT_PREPARE, COM_STMT_EXECUTE, COM_STMT_FETCH, COM_STMT_CLOSE, COM_STMT_RESET, COM_STMT_SEND_LONG_DATA:
+		return bufferedResponse{&PreparedResponse{server: server, session: session, cmd: cmd}}
 	default:
-		return &UtilityResponse{server: server, cmd: cmd}
+		return bufferedResponse{&UtilityResponse{server: server, session: session, cmd: cmd}}
+	}
+}
+
+func (r bufferedResponse) ResponsePacket(client Connector) error {
+	holdWrites(client)
+	err := r.Responser.ResponsePacket(client)
+	if ferr := flushWrites(client); err == nil {
+		err = ferr
 	}
+	return err
+}
+
+func holdWrites(c Connector) {
+	if w, ok := c.(*Conn); ok {
+		w.Hold()
+	}
+}
+
+func flushWrites(c Connector) error {
+	if w, ok := c.(*Conn); ok {
+		return w.Flush()
+	}
+	return nil
 }
 
 func TransportPacket(src, dst Connector) (Packet, error) {
-	p, err := src.ReadPacket()
+	var p Packet
+	var err error
+	if c, ok := src.(*Conn); ok {
+		p, err = c.readPacket(true)
+	} else {
+		p, err = src.ReadPacket()
+	}
 	if err != nil {
 		return p, fmt.Errorf("read src err: %w", err)
 	}
@@ -47,27 +92,152 @@ func TransportPacket(src, dst Connector) (Packet, error) {
 	return p, nil
 }
 
-func (r *QueryResponse) ResponsePacket(client Connector) error {
-	columnEnd := false
-	for {
-		p, err := TransportPacket(r.server, client)
+// 转发 n 个包, 不需要判断包的内容, 大包直接复制
+func TransportPackets(src, dst Connector, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := StreamPacket(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 转发结果集中 column count 之后的部分, 直到最后一行之后的 EOF (或 OK) 包
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response_text_resultset.html
+func (s *Session) transportResultSet(server, client Connector, columnCount Packet) error {
+	r := reader{data: columnCount.Payload}
+	columns := r.lenEncInt()
+	metadata := RESULTSET_METADATA_FULL
+	if s.Capability&CLIENT_OPTIONAL_RESULTSET_METADATA != 0 {
+		metadata = r.byte()
+	}
+	if r.err != nil {
+		return fmt.Errorf("parse column count err: %w", r.err)
+	}
+
+	if metadata == RESULTSET_METADATA_FULL {
+		if err := TransportPackets(server, client, int(columns)); err != nil {
+			return err
+		}
+	}
+	if !s.DeprecateEOF() {
+		p, err := TransportPacket(server, client)
 		if err != nil {
 			return err
 		}
+		s.Update(p)
 
-		if IsOkPacket(p) || IsErrPacket(p) {
+		// COM_STMT_EXECUTE 使用 CURSOR_TYPE_READ_ONLY 打开游标时没有数据行, 之后由 COM_STMT_FETCH 读取
+		if s.Status&SERVER_STATUS_CURSOR_EXISTS != 0 {
 			return nil
 		}
+	}
 
-		if IsEofPacket(p) {
-			if columnEnd {
-				// data end
-				return nil
-			} else {
-				columnEnd = true
+	// CLIENT_DEPRECATE_EOF 时打开游标, column definition 之后直接是结束结果集的 OK 包, 由 transportRows 读取
+	return s.transportRows(server, client)
+}
+
+// 转发数据行, 直到 ERR 或结束结果集的 EOF (或 OK) 包
+// 大的数据行 (BLOB 等) 直接复制, 不会完整读入内存
+func (s *Session) transportRows(server, client Connector) error {
+	for {
+		p, err := StreamPacket(server, client)
+		if err != nil {
+			return err
+		}
+		if IsErrPacket(p) {
+			s.Status &^= SERVER_MORE_RESULTS_EXISTS
+			return nil
+		}
+		if s.IsResultSetEnd(p) {
+			s.Update(p)
+			return nil
+		}
+	}
+}
+
+// 转发一个或多个结果, 结果的 OK 或 EOF 包中有 SERVER_MORE_RESULTS_EXISTS 时继续读取下一个结果
+// 存储过程 (CALL) 和多语句查询会返回多个结果, 最后是 OK 包
+func (s *Session) transportResults(server, client Connector) error {
+	for {
+		p, err := server.ReadPacket()
+		if err != nil {
+			return fmt.Errorf("read src err: %w", err)
+		}
+		if IsLocalInfilePacket(p) {
+			p, err = s.localInfile(server, client, p)
+			if err != nil {
+				return err
 			}
 		}
+		if err := client.WritePacket(p); err != nil {
+			return fmt.Errorf("write dst err: %w", err)
+		}
+
+		switch {
+		case IsErrPacket(p):
+			// 出错后不会再有后续的结果
+			s.Status &^= SERVER_MORE_RESULTS_EXISTS
+			return nil
+		case IsOkPacket(p):
+			s.Update(p)
+		default:
+			if err := s.transportResultSet(server, client, p); err != nil {
+				return err
+			}
+		}
+
+		if s.Status&SERVER_MORE_RESULTS_EXISTS == 0 {
+			return nil
+		}
+	}
+}
+
+// LOAD DATA LOCAL INFILE, 转发客户端发送的文件内容直到空包, 返回服务端的 OK 或 ERR 包
+// 没有协商 CLIENT_LOCAL_FILES 时拒绝请求, 不会把请求发给客户端
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response_local_infile_request.html
+func (s *Session) localInfile(server, client Connector, request Packet) (Packet, error) {
+	if s.Capability&CLIENT_LOCAL_FILES == 0 {
+		// 空包表示没有文件内容, 结果使用请求的序号发给客户端
+		err := server.WritePacket(Packet{SeqId: request.SeqId + 1})
+		if err != nil {
+			return request, fmt.Errorf("write dst err: %w", err)
+		}
+		result, err := server.ReadPacket()
+		if err != nil {
+			return result, fmt.Errorf("read src err: %w", err)
+		}
+		result.SeqId = request.SeqId
+		return result, nil
 	}
+
+	if err := client.WritePacket(request); err != nil {
+		return request, fmt.Errorf("write dst err: %w", err)
+	}
+	// 客户端收到请求后才会发送文件内容
+	if err := flushWrites(client); err != nil {
+		return request, fmt.Errorf("write dst err: %w", err)
+	}
+	defer holdWrites(client)
+	for {
+		p, err := TransportPacket(client, server)
+		if err != nil {
+			return p, err
+		}
+		if len(p.Payload) == 0 {
+			break
+		}
+	}
+
+	result, err := server.ReadPacket()
+	if err != nil {
+		return result, fmt.Errorf("read src err: %w", err)
+	}
+	return result, nil
+}
+
+func (r *QueryResponse) ResponsePacket(client Connector) error {
+	return r.session.transportResults(r.server, client)
 }
 
 func (r *UtilityResponse) ResponsePacket(client Connector) error {
@@ -75,13 +245,15 @@ func (r *UtilityResponse) ResponsePacket(client Connector) error {
 		return ErrClientQuit
 	}
 
+	// column definition 直到 EOF
 	if r.cmd == COM_FIELD_LIST {
 		for {
-			p, err := TransportPacket(r.server, client)
+			p, err := StreamPacket(r.server, client)
 			if err != nil {
 				return err
 			}
-			if IsEofPacket(p) || IsErrPacket(p) {
+			if r.session.IsResultSetEnd(p) || IsErrPacket(p) {
+				r.session.Update(p)
 				return nil
 			}
 		}
@@ -93,11 +265,12 @@ func (r *UtilityResponse) ResponsePacket(client Connector) error {
 	}
 
 	if r.cmd == COM_CHANGE_USER {
-		_, err := TransportPacket(r.server, client)
+		p, err := TransportPacket(r.server, client)
+		r.session.Update(p)
 		return err
 	}
 
-	queryResp := &QueryResponse{server: r.server}
+	queryResp := &QueryResponse{server: r.server, session: r.session}
 	return queryResp.ResponsePacket(client)
 }
 
@@ -107,70 +280,39 @@ func (r *PreparedResponse) ResponsePacket(client Connector) error {
 	}
 
 	// 预处理sql响应
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_prepare.html
 	if r.cmd == COM_STMT_PREPARE {
 		p, err := TransportPacket(r.server, client)
 		if err != nil {
 			return err
 		}
-		// 响应成功
-		if IsOkPacket(p) {
-			// columns， parameters 都为 0
-			if len(p.Payload) > 8 && p.Payload[5] == 0 && p.Payload[6] == 0 && p.Payload[7] == 0 && p.Payload[8] == 0 {
-				return nil
-			}
-			eofCount := 0
-
-			// columns 为0
-			if len(p.Payload) > 8 && p.Payload[5] == 0 && p.Payload[6] == 0 {
-				eofCount = 1
-			}
-			// parameters 为0
-			if len(p.Payload) > 8 && p.Payload[7] == 0 && p.Payload[8] == 0 {
-				eofCount = 1
-			}
-			for {
-				p2, err2 := TransportPacket(r.server, client)
-				if err2 != nil {
-					return err2
-				}
-				if IsEofPacket(p2) {
-					if eofCount == 1 {
-						return nil
-					} else {
-						eofCount++
-					}
-				}
-			}
+		if !IsOkPacket(p) {
+			return nil
 		}
-		return nil
-	}
 
-	// 预处理语句响应
-	if r.cmd == COM_STMT_EXECUTE {
-		p, err := TransportPacket(r.server, client)
+		ok, err := r.session.ParsePrepareOk(p)
 		if err != nil {
 			return err
 		}
-		if IsErrPacket(p) || IsOkPacket(p) {
-			return nil
-		}
-		eofCount := 0
-		for {
-			p2, err2 := TransportPacket(r.server, client)
-			if err2 != nil {
-				return err2
-			}
-			if IsEofPacket(p2) {
-				if eofCount == 1 {
-					return nil
-				} else {
-					eofCount++
-				}
-			}
-		}
+		r.session.AddStatement(ok.StatementId, int(ok.Params))
+		return TransportPackets(r.server, client, r.session.PrepareDefinitions(ok))
 	}
 
-	// 响应失败
-	_, err := TransportPacket(r.server, client)
+	// 预处理语句响应, binary 结果集, CALL 时有多个结果
+	if r.cmd == COM_STMT_EXECUTE {
+		return r.session.transportResults(r.server, client)
+	}
+
+	// 从游标读取数据行, 游标读完时结尾的 EOF 中没有 SERVER_STATUS_CURSOR_EXISTS
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_fetch.html
+	if r.cmd == COM_STMT_FETCH {
+		return r.session.transportRows(r.server, client)
+	}
+
+	// COM_STMT_RESET 的 OK 或 ERR
+	p, err := TransportPacket(r.server, client)
+	if err == nil && IsOkPacket(p) {
+		r.session.Update(p)
+	}
 	return err
 }
@@ -0,0 +1,238 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testColumn = Packet{Payload: []byte{3, 'd', 'e', 'f', 0, 0, 0, 1, 'a', 0, 0x0c, 0x3f, 0, 0, 0, 0, 0, 0x0f, 0, 0, 0, 0}}
+	testEOF    = Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x02, 0}}
+)
+
+// 转发一个命令的响应, 返回客户端收到的包, 服务端的包需要正好读完
+func testResponse(t *testing.T, session *Session, cmd byte, packets ...Packet) []Packet {
+	for i := range packets {
+		packets[i].SeqId = uint8(i + 1)
+	}
+	server := NewBufferConn(nil, packetBytes(packets...))
+	client := NewBufferConn(nil, nil)
+
+	err := NewResponse(NewConn(server), cmd, session).ResponsePacket(NewConn(client))
+	assert.Nil(t, err, "response err")
+	assert.Zero(t, server.readBuffer.Len(), "response not fully read")
+	return readPackets(t, client.writeBuffer.Bytes())
+}
+
+func TestResultSetDeprecateEOF(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF}
+
+	// 0xfe 开头的 OK 包, 带有 info 时长度大于 9
+	end := Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x03, 0, 0, 0, 5, 'i', 'n', 'f', 'o', '!'}}
+	packets := testResponse(t, session, COM_QUERY,
+		Packet{Payload: []byte{1}},
+		testColumn,
+		Packet{Payload: []byte{1, 'x'}},
+		Packet{Payload: []byte{0}},
+		end,
+	)
+	assert.Len(t, packets, 5, "response packets err")
+	assert.True(t, session.InTransaction(), "status not updated")
+}
+
+func TestResultSetEOF(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+
+	// 0xfe 开头的数据行 (8 字节长度的字符串)
+	row := Packet{Payload: append([]byte{0xfe, 1, 0, 0, 0, 0, 0, 0, 0}, 'x')}
+	packets := testResponse(t, session, COM_QUERY,
+		Packet{Payload: []byte{1}},
+		testColumn,
+		testEOF,
+		row,
+		testEOF,
+	)
+	assert.Len(t, packets, 5, "response packets err")
+	assert.Equal(t, SERVER_STATUS_AUTOCOMMIT, session.Status, "status not updated")
+}
+
+func TestResultSetNoMetadata(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF | CLIENT_OPTIONAL_RESULTSET_METADATA}
+	packets := testResponse(t, session, COM_QUERY,
+		Packet{Payload: []byte{2, RESULTSET_METADATA_NONE}},
+		Packet{Payload: []byte{1, 'x', 1, 'y'}},
+		Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x02, 0, 0, 0}},
+	)
+	assert.Len(t, packets, 3, "response packets err")
+}
+
+func TestPrepareResponse(t *testing.T) {
+	// statement_id 1, 1 column, 2 params
+	ok := Packet{Payload: []byte{OK_PACKET, 1, 0, 0, 0, 1, 0, 2, 0, 0, 0, 0}}
+
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+	packets := testResponse(t, session, COM_STMT_PREPARE,
+		ok, testColumn, testColumn, testEOF, testColumn, testEOF)
+	assert.Len(t, packets, 6, "response packets err")
+	assert.Equal(t, []uint32{1}, session.Statements(), "statement not recorded")
+
+	packets = testResponse(t, &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF}, COM_STMT_PREPARE,
+		ok, testColumn, testColumn, testColumn)
+	assert.Len(t, packets, 4, "deprecate eof response packets err")
+}
+
+func TestExecuteResponse(t *testing.T) {
+	// binary 数据行以 0x00 开头
+	row := Packet{Payload: []byte{0, 0, 1, 'x'}}
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF}
+	packets := testResponse(t, session, COM_STMT_EXECUTE,
+		Packet{Payload: []byte{1}},
+		testColumn,
+		row,
+		row,
+		Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x02, 0, 0, 0}},
+	)
+	assert.Len(t, packets, 5, "response packets err")
+}
+
+// 带有状态的 OK 包
+func testOk(status uint16) Packet {
+	return Packet{Payload: []byte{OK_PACKET, 0, 0, byte(status), byte(status >> 8), 0, 0}}
+}
+
+func TestMultiResultsCall(t *testing.T) {
+	more := SERVER_STATUS_AUTOCOMMIT | SERVER_MORE_RESULTS_EXISTS
+	moreEOF := Packet{Payload: []byte{EOF_PACKET, 0, 0, byte(more), 0}}
+	row := Packet{Payload: []byte{1, 'x'}}
+
+	// CALL p(): 两个结果集, 最后是存储过程的 OK 包
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_MULTI_RESULTS}
+	packets := testResponse(t, session, COM_QUERY,
+		Packet{Payload: []byte{1}}, testColumn, moreEOF, row, moreEOF,
+		Packet{Payload: []byte{1}}, testColumn, moreEOF, row, row, moreEOF,
+		testOk(SERVER_STATUS_AUTOCOMMIT),
+	)
+	assert.Len(t, packets, 12, "response packets err")
+	assert.Equal(t, SERVER_STATUS_AUTOCOMMIT, session.Status, "status err")
+
+	// COM_STMT_EXECUTE CALL, CLIENT_DEPRECATE_EOF
+	session = &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_MULTI_RESULTS | CLIENT_PS_MULTI_RESULTS | CLIENT_DEPRECATE_EOF}
+	moreOk := Packet{Payload: []byte{EOF_PACKET, 0, 0, byte(more), 0, 0, 0}}
+	packets = testResponse(t, session, COM_STMT_EXECUTE,
+		Packet{Payload: []byte{1}}, testColumn, Packet{Payload: []byte{0, 0, 1, 'x'}}, moreOk,
+		testOk(SERVER_STATUS_AUTOCOMMIT),
+	)
+	assert.Len(t, packets, 5, "execute response packets err")
+}
+
+func TestMultiStatements(t *testing.T) {
+	more := SERVER_STATUS_AUTOCOMMIT | SERVER_MORE_RESULTS_EXISTS
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_MULTI_STATEMENTS | CLIENT_MULTI_RESULTS | CLIENT_DEPRECATE_EOF}
+
+	// update a; select b; update c
+	packets := testResponse(t, session, COM_QUERY,
+		testOk(more),
+		Packet{Payload: []byte{1}}, testColumn, Packet{Payload: []byte{1, 'b'}}, Packet{Payload: []byte{EOF_PACKET, 0, 0, byte(more), 0, 0, 0}},
+		testOk(SERVER_STATUS_AUTOCOMMIT),
+	)
+	assert.Len(t, packets, 6, "response packets err")
+	assert.Equal(t, SERVER_STATUS_AUTOCOMMIT, session.Status, "status err")
+
+	// 第二条语句出错时不再有后续结果
+	packets = testResponse(t, session, COM_QUERY,
+		testOk(more),
+		NewErrPacket(1146, "42S02", "Table 'b' doesn't exist", 0),
+	)
+	assert.Len(t, packets, 2, "error response packets err")
+	assert.Zero(t, session.Status&SERVER_MORE_RESULTS_EXISTS, "more results after err")
+}
+
+func TestCursorResponse(t *testing.T) {
+	// SERVER_STATUS_AUTOCOMMIT | SERVER_STATUS_CURSOR_EXISTS
+	cursorEOF := Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x42, 0}}
+	row := Packet{Payload: []byte{0, 0, 1, 'x'}}
+
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+	packets := testResponse(t, session, COM_STMT_EXECUTE,
+		Packet{Payload: []byte{1}},
+		testColumn,
+		cursorEOF,
+	)
+	assert.Len(t, packets, 3, "execute response packets err")
+	assert.False(t, session.Idle(), "cursor not open")
+
+	packets = testResponse(t, session, COM_STMT_FETCH, row, row, cursorEOF)
+	assert.Len(t, packets, 3, "fetch response packets err")
+
+	// 游标读完, SERVER_STATUS_AUTOCOMMIT | SERVER_STATUS_LAST_ROW_SENT
+	packets = testResponse(t, session, COM_STMT_FETCH, row, Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x82, 0}})
+	assert.Len(t, packets, 2, "last fetch response packets err")
+	assert.True(t, session.Idle(), "cursor not closed")
+}
+
+func TestCursorResponseDeprecateEOF(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF}
+	packets := testResponse(t, session, COM_STMT_EXECUTE,
+		Packet{Payload: []byte{1}},
+		testColumn,
+		Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x42, 0, 0, 0}},
+	)
+	assert.Len(t, packets, 3, "execute response packets err")
+	assert.False(t, session.Idle(), "cursor not open")
+}
+
+func TestLocalInfile(t *testing.T) {
+	request := Packet{Payload: append([]byte{LOCAL_INFILE_PACKET}, "a.csv"...), SeqId: 1}
+	ok := Packet{Payload: []byte{OK_PACKET, 2, 0, 0x02, 0, 0, 0}, SeqId: 4}
+	server := NewBufferConn(nil, packetBytes(request, ok))
+	client := NewBufferConn(nil, packetBytes(Packet{Payload: []byte("1,2\n3,4\n"), SeqId: 2}, Packet{SeqId: 3}))
+
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_LOCAL_FILES}
+	err := NewResponse(NewConn(server), COM_QUERY, session).ResponsePacket(NewConn(client))
+	assert.Nil(t, err, "response err")
+	assert.Zero(t, client.readBuffer.Len(), "file content not fully read")
+
+	sent := readPackets(t, server.writeBuffer.Bytes())
+	assert.Len(t, sent, 2, "file packets err")
+	assert.Equal(t, Packet{SeqId: 3}, sent[1], "file terminator err")
+	packets := readPackets(t, client.writeBuffer.Bytes())
+	assert.Equal(t, []Packet{request, ok}, packets, "response packets err")
+}
+
+func TestLocalInfileRefused(t *testing.T) {
+	request := Packet{Payload: append([]byte{LOCAL_INFILE_PACKET}, "/etc/passwd"...), SeqId: 1}
+	result := Packet{Payload: []byte{ERR_PACKET, 0x3c, 0x0f, '#', 'H', 'Y', '0', '0', '0'}, SeqId: 3}
+	server := NewBufferConn(nil, packetBytes(request, result))
+	client := NewBufferConn(nil, nil)
+
+	// 没有协商 CLIENT_LOCAL_FILES, 请求不会发给客户端
+	err := NewResponse(NewConn(server), COM_QUERY, &Session{Capability: CLIENT_PROTOCOL_41}).ResponsePacket(NewConn(client))
+	assert.Nil(t, err, "response err")
+	assert.Equal(t, []Packet{{SeqId: 2}}, readPackets(t, server.writeBuffer.Bytes()), "empty file packet err")
+
+	packets := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, packets, 1, "response packets err")
+	assert.Equal(t, uint8(1), packets[0].SeqId, "response seq err")
+	assert.True(t, IsErrPacket(packets[0]), "response err packet err")
+}
+
+// CLIENT_SESSION_TRACK 时从 OK 包的会话状态中得到当前数据库的变化
+func TestSessionTrackSchema(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_SESSION_TRACK}
+	status := SERVER_STATUS_AUTOCOMMIT | SERVER_SESSION_STATE_CHANGED
+	// 系统变量 autocommit 的变化
+	variable := []byte{0x00, 14, 10, 'a', 'u', 't', 'o', 'c', 'o', 'm', 'm', 'i', 't', 2, 'O', 'N'}
+	schema := []byte{SESSION_TRACK_SCHEMA, 5, 4, 't', 'e', 's', 't'}
+	ok := func(state []byte) Packet {
+		info := AppendLenEncString([]byte{0}, state)
+		return Packet{Payload: OkPacket{Status: status, Info: info}.Encode(), SeqId: 1}
+	}
+
+	session.Update(ok(variable))
+	assert.Equal(t, status, session.Status, "status err")
+	assert.False(t, session.DatabaseChanged, "database changed")
+
+	session.Update(ok(append(variable, schema...)))
+	assert.True(t, session.DatabaseChanged, "database change not tracked")
+}
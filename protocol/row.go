@@ -0,0 +1,119 @@
+package protocol
+
+import "fmt"
+
+// 二进制协议中不是固定长度的值
+const (
+	// 长度编码的字符串
+	binaryLenEncValue = -1
+	// 1 字节长度加内容, 日期和时间
+	binaryShortValue = -2
+)
+
+// 数据行中每一列的值, NULL 为 nil
+// 二进制协议中字符串类型不包括长度前缀, 日期和时间类型不包括长度字节
+type Row [][]byte
+
+// 文本协议的数据行, 每列是长度编码的字符串, NULL 为 0xfb
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response_text_resultset_row.html
+func ParseTextRow(data []byte, columns int) (Row, error) {
+	row := make(Row, columns)
+	r := reader{data: data}
+	for i := range row {
+		if r.pos < len(r.data) && r.data[r.pos] == NULL_VALUE {
+			r.skip(1)
+			continue
+		}
+		row[i] = append([]byte{}, r.lenEncBytes()...)
+	}
+	if r.err != nil || !r.eof() {
+		return row, fmt.Errorf("parse text row err: %w", ErrMalformedPacket)
+	}
+	return row, nil
+}
+
+func (row Row) EncodeText() []byte {
+	b := make([]byte, 0, 64)
+	for _, v := range row {
+		if v == nil {
+			b = append(b, NULL_VALUE)
+			continue
+		}
+		b = AppendLenEncString(b, v)
+	}
+	return b
+}
+
+// 二进制协议的数据行: 0x00 包头, NULL bitmap (偏移 2 位), 非 NULL 的值
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_binary_resultset.html
+func ParseBinaryRow(data []byte, columns []ColumnDefinition) (Row, error) {
+	row := make(Row, len(columns))
+	r := reader{data: data}
+	if r.byte() != OK_PACKET {
+		return row, fmt.Errorf("parse binary row err: %w", ErrMalformedPacket)
+	}
+	bitmap := r.bytes((len(columns) + 7 + 2) / 8)
+	for i, col := range columns {
+		if r.err != nil {
+			break
+		}
+		if bitmap[(i+2)/8]&(1<<uint((i+2)%8)) != 0 {
+			continue
+		}
+		switch n := binaryValueLength(col.Type); n {
+		case binaryLenEncValue:
+			row[i] = append([]byte{}, r.lenEncBytes()...)
+		case binaryShortValue:
+			row[i] = append([]byte{}, r.bytes(int(r.byte()))...)
+		default:
+			row[i] = append([]byte{}, r.bytes(n)...)
+		}
+	}
+	if r.err != nil || !r.eof() {
+		return row, fmt.Errorf("parse binary row err: %w", ErrMalformedPacket)
+	}
+	return row, nil
+}
+
+func (row Row) EncodeBinary(columns []ColumnDefinition) []byte {
+	bitmap := make([]byte, (len(columns)+7+2)/8)
+	values := make([]byte, 0, 64)
+	for i, col := range columns {
+		v := row[i]
+		if v == nil {
+			bitmap[(i+2)/8] |= 1 << uint((i+2)%8)
+			continue
+		}
+		switch binaryValueLength(col.Type) {
+		case binaryLenEncValue:
+			values = AppendLenEncString(values, v)
+		case binaryShortValue:
+			values = append(append(values, byte(len(v))), v...)
+		default:
+			values = append(values, v...)
+		}
+	}
+	b := make([]byte, 0, 1+len(bitmap)+len(values))
+	b = append(b, OK_PACKET)
+	b = append(b, bitmap...)
+	return append(b, values...)
+}
+
+// 二进制协议中值的长度
+func binaryValueLength(t byte) int {
+	switch t {
+	case MYSQL_TYPE_NULL:
+		return 0
+	case MYSQL_TYPE_TINY:
+		return 1
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		return 2
+	case MYSQL_TYPE_LONG, MYSQL_TYPE_INT24, MYSQL_TYPE_FLOAT:
+		return 4
+	case MYSQL_TYPE_LONGLONG, MYSQL_TYPE_DOUBLE:
+		return 8
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIMESTAMP, MYSQL_TYPE_TIME:
+		return binaryShortValue
+	}
+	return binaryLenEncValue
+}
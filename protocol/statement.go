@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const ER_UNKNOWN_STMT_HANDLER uint16 = 1243
+
+type (
+	// COM_STMT_PREPARE 成功时的 OK 包
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_prepare.html
+	PrepareOk struct {
+		StatementId uint32
+		Columns     uint16
+		Params      uint16
+		Warnings    uint16
+		Metadata    byte
+	}
+)
+
+func (s *Session) ParsePrepareOk(p Packet) (PrepareOk, error) {
+	ok := PrepareOk{Metadata: RESULTSET_METADATA_FULL}
+	r := reader{data: p.Payload}
+	if r.byte() != OK_PACKET {
+		return ok, ErrMalformedPacket
+	}
+	ok.StatementId = r.uint32()
+	ok.Columns = r.uint16()
+	ok.Params = r.uint16()
+	r.skip(1)
+	ok.Warnings = r.uint16()
+	if s.Capability&CLIENT_OPTIONAL_RESULTSET_METADATA != 0 && !r.eof() {
+		ok.Metadata = r.byte()
+	}
+	if r.err != nil {
+		return ok, fmt.Errorf("parse prepare ok err: %w", r.err)
+	}
+	return ok, nil
+}
+
+// 服务端协商了 CLIENT_OPTIONAL_RESULTSET_METADATA 时才有 metadata 标记
+func (ok PrepareOk) Encode(capability uint32) []byte {
+	b := make([]byte, 0, 13)
+	b = append(b, OK_PACKET)
+	b = append(b, uint32Bytes(ok.StatementId)...)
+	b = append(b, uint16Bytes(ok.Columns)...)
+	b = append(b, uint16Bytes(ok.Params)...)
+	b = append(b, 0)
+	b = append(b, uint16Bytes(ok.Warnings)...)
+	if capability&CLIENT_OPTIONAL_RESULTSET_METADATA != 0 {
+		b = append(b, ok.Metadata)
+	}
+	return b
+}
+
+// OK 包之后 parameter 和 column definition 的包数, 不为 0 时各自以 EOF 结束
+func (s *Session) PrepareDefinitions(ok PrepareOk) int {
+	if ok.Metadata == RESULTSET_METADATA_NONE {
+		return 0
+	}
+	n := 0
+	for _, count := range []uint16{ok.Params, ok.Columns} {
+		if count == 0 {
+			continue
+		}
+		n += int(count)
+		if !s.DeprecateEOF() {
+			n++
+		}
+	}
+	return n
+}
+
+// 命令中的预处理语句 id, 在命令字节之后的 4 字节
+func StatementId(cmd Packet) (uint32, bool) {
+	if len(cmd.Payload) < 5 {
+		return 0, false
+	}
+	switch cmd.Payload[0] {
+	case COM_STMT_EXECUTE, COM_STMT_SEND_LONG_DATA, COM_STMT_CLOSE, COM_STMT_RESET, COM_STMT_FETCH:
+		return binary.LittleEndian.Uint32(cmd.Payload[1:5]), true
+	}
+	return 0, false
+}
+
+// 替换命令或 PREPARE OK 包中的语句 id, 返回新的包
+func SetStatementId(p Packet, id uint32) Packet {
+	payload := append([]byte{}, p.Payload...)
+	if len(payload) >= 5 {
+		binary.LittleEndian.PutUint32(payload[1:5], id)
+	}
+	return Packet{Payload: payload, SeqId: p.SeqId}
+}
+
+// COM_STMT_EXECUTE 中 new_params_bound_flag 的位置和参数个数, 没有参数时位置为 0
+// CLIENT_QUERY_ATTRIBUTES 时参数个数包含 query attributes
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_execute.html
+func (s *Session) executeParams(cmd Packet, params int) (int, int, error) {
+	r := reader{data: cmd.Payload}
+	r.skip(5)
+	flags := r.byte()
+	r.skip(4)
+	count := uint64(params)
+	if s.Capability&CLIENT_QUERY_ATTRIBUTES != 0 && (params > 0 || flags&PARAMETER_COUNT_AVAILABLE != 0) {
+		count = r.lenEncInt()
+	}
+	if r.err != nil || count == 0 {
+		return 0, 0, r.err
+	}
+	r.skip(int((count + 7) / 8))
+	if r.err != nil || r.eof() {
+		return 0, 0, ErrMalformedPacket
+	}
+	return r.pos, int(count), nil
+}
+
+// COM_STMT_EXECUTE 绑定的参数类型 (CLIENT_QUERY_ATTRIBUTES 时包括参数名), 和参数个数
+// new_params_bound_flag 为 0 时类型为 nil, 服务端使用上一次执行的类型
+func (s *Session) ExecuteTypes(cmd Packet, params int) ([]byte, int, error) {
+	pos, count, err := s.executeParams(cmd, params)
+	if err != nil || count == 0 || cmd.Payload[pos] != 1 {
+		return nil, count, err
+	}
+
+	r := reader{data: cmd.Payload, pos: pos + 1}
+	for i := 0; i < count; i++ {
+		r.skip(2)
+		if s.Capability&CLIENT_QUERY_ATTRIBUTES != 0 {
+			r.lenEncBytes()
+		}
+	}
+	if r.err != nil {
+		return nil, count, fmt.Errorf("parse execute types err: %w", r.err)
+	}
+	return append([]byte{}, cmd.Payload[pos+1:r.pos]...), count, nil
+}
+
+// new_params_bound_flag 为 0 时补上参数类型, 语句在另一个连接上执行过时服务端没有上一次的类型
+func (s *Session) BindExecuteTypes(cmd Packet, params int, types []byte, typesCount int) (Packet, error) {
+	pos, count, err := s.executeParams(cmd, params)
+	if err != nil {
+		return cmd, err
+	}
+	if count == 0 || cmd.Payload[pos] == 1 || count != typesCount {
+		return cmd, nil
+	}
+
+	payload := make([]byte, 0, len(cmd.Payload)+len(types))
+	payload = append(payload, cmd.Payload[:pos]...)
+	payload = append(payload, 1)
+	payload = append(payload, types...)
+	payload = append(payload, cmd.Payload[pos+1:]...)
+	return Packet{Payload: payload, SeqId: cmd.SeqId}, nil
+}
+
+// 记录 COM_STMT_PREPARE 成功后服务端返回的语句 id 和参数个数
+func (s *Session) AddStatement(id uint32, params int) {
+	if s.statements == nil {
+		s.statements = make(map[uint32]int)
+	}
+	s.statements[id] = params
+}
+
+// 预处理语句的参数个数
+func (s *Session) StatementParams(id uint32) (int, bool) {
+	params, ok := s.statements[id]
+	return params, ok
+}
+
+// 客户端命令释放的预处理语句不再需要清理
+// COM_RESET_CONNECTION 和 COM_CHANGE_USER 会释放连接上所有的预处理语句
+func (s *Session) ReleaseStatements(cmd Packet) {
+	if len(cmd.Payload) == 0 {
+		return
+	}
+	switch cmd.Payload[0] {
+	case COM_STMT_CLOSE:
+		if id, ok := StatementId(cmd); ok {
+			delete(s.statements, id)
+		}
+	case COM_RESET_CONNECTION, COM_CHANGE_USER:
+		s.statements = nil
+	}
+}
+
+// 客户端没有关闭的预处理语句
+func (s *Session) Statements() []uint32 {
+	ids := make([]uint32, 0, len(s.statements))
+	for id := range s.statements {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// 发送 COM_STMT_CLOSE, 服务端不会响应
+func CloseStatement(c Connector, id uint32) error {
+	payload := make([]byte, 5)
+	payload[0] = COM_STMT_CLOSE
+	binary.LittleEndian.PutUint32(payload[1:], id)
+	if err := c.WritePacket(Packet{Payload: payload}); err != nil {
+		return fmt.Errorf("send stmt close err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseStatements(t *testing.T) {
+	session := &Session{}
+	session.AddStatement(2, 0)
+	session.AddStatement(1, 0)
+	assert.Equal(t, []uint32{1, 2}, session.Statements(), "statements err")
+
+	session.ReleaseStatements(Packet{Payload: []byte{COM_STMT_CLOSE, 2, 0, 0, 0}})
+	assert.Equal(t, []uint32{1}, session.Statements(), "closed statement not released")
+
+	// 执行不会释放语句
+	session.ReleaseStatements(Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0}})
+	assert.Equal(t, []uint32{1}, session.Statements(), "executed statement released")
+
+	session.ReleaseStatements(Packet{Payload: []byte{COM_RESET_CONNECTION}})
+	assert.Empty(t, session.Statements(), "reset connection not released")
+}
+
+func TestCloseStatement(t *testing.T) {
+	buf := NewBufferConn(nil, nil)
+	err := CloseStatement(NewConn(buf), 0x0102)
+	assert.Nil(t, err, "close statement err")
+	assert.Equal(t, []Packet{{Payload: []byte{COM_STMT_CLOSE, 2, 1, 0, 0}}}, readPackets(t, buf.writeBuffer.Bytes()), "close packet err")
+}
+
+func TestExecuteTypes(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41}
+	// 2 个参数, null bitmap, new_params_bound_flag, 类型 LONGLONG 和 VAR_STRING
+	bound := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 0xfd, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'a'}}
+	types, count, err := session.ExecuteTypes(bound, 2)
+	assert.Nil(t, err, "parse types err")
+	assert.Equal(t, 2, count, "params count err")
+	assert.Equal(t, []byte{0x08, 0, 0xfd, 0}, types, "types err")
+
+	unbound := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'a'}}
+	types, _, err = session.ExecuteTypes(unbound, 2)
+	assert.Nil(t, err, "parse types err")
+	assert.Nil(t, types, "unbound types err")
+
+	p, err := session.BindExecuteTypes(unbound, 2, []byte{0x08, 0, 0xfd, 0}, 2)
+	assert.Nil(t, err, "bind types err")
+	assert.Equal(t, bound, p, "bind types packet err")
+
+	// CLIENT_QUERY_ATTRIBUTES 时有参数个数和参数名
+	session.Capability |= CLIENT_QUERY_ATTRIBUTES
+	attrs := Packet{Payload: []byte{COM_STMT_EXECUTE, 1, 0, 0, 0, PARAMETER_COUNT_AVAILABLE, 1, 0, 0, 0, 1, 0, 1, 0xfd, 0, 1, 'n', 1, 'v'}}
+	types, count, err = session.ExecuteTypes(attrs, 0)
+	assert.Nil(t, err, "parse attributes err")
+	assert.Equal(t, 1, count, "attributes count err")
+	assert.Equal(t, []byte{0xfd, 0, 1, 'n'}, types, "attributes types err")
+}
@@ -0,0 +1,180 @@
+package protocol
+
+// OK 和 EOF 包中的服务端状态
+// https://dev.mysql.com/doc/dev/mysql-server/latest/mysql__com_8h.html
+const (
+	SERVER_STATUS_IN_TRANS             uint16 = 0x0001
+	SERVER_STATUS_AUTOCOMMIT           uint16 = 0x0002
+	SERVER_MORE_RESULTS_EXISTS         uint16 = 0x0008
+	SERVER_QUERY_NO_GOOD_INDEX_USED    uint16 = 0x0010
+	SERVER_QUERY_NO_INDEX_USED         uint16 = 0x0020
+	SERVER_STATUS_CURSOR_EXISTS        uint16 = 0x0040
+	SERVER_STATUS_LAST_ROW_SENT        uint16 = 0x0080
+	SERVER_STATUS_DB_DROPPED           uint16 = 0x0100
+	SERVER_STATUS_NO_BACKSLASH_ESCAPES uint16 = 0x0200
+	SERVER_STATUS_METADATA_CHANGED     uint16 = 0x0400
+	SERVER_QUERY_WAS_SLOW              uint16 = 0x0800
+	SERVER_PS_OUT_PARAMS               uint16 = 0x1000
+	SERVER_STATUS_IN_TRANS_READONLY    uint16 = 0x2000
+	SERVER_SESSION_STATE_CHANGED       uint16 = 0x4000
+)
+
+// CLIENT_SESSION_TRACK 时 OK 包中会话状态变化的类型, 当前数据库变化
+// https://dev.mysql.com/doc/dev/mysql-server/latest/mysql__com_8h.html
+const SESSION_TRACK_SCHEMA byte = 0x01
+
+type (
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_ok_packet.html
+	OkPacket struct {
+		AffectedRows uint64
+		LastInsertId uint64
+		Status       uint16
+		Warnings     uint16
+		// 其余部分, info 和 session state 信息
+		Info []byte
+	}
+
+	// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_eof_packet.html
+	EofPacket struct {
+		Warnings uint16
+		Status   uint16
+	}
+
+	// 客户端会话的状态, 由命令响应中的 OK 和 EOF 包更新
+	Session struct {
+		Status uint16
+		// 客户端与服务端协商的 capability
+		Capability uint32
+		// 客户端还没有关闭的预处理语句和参数个数
+		statements map[uint32]int
+		// 客户端切换过当前数据库, 由 OK 包的会话状态或客户端命令设置
+		DatabaseChanged bool
+		// 当前命令中客户端发送的 query attributes
+		Attributes QueryAttributes
+	}
+)
+
+func ParseOkPacket(data []byte) (OkPacket, error) {
+	ok := OkPacket{}
+	r := reader{data: data}
+	if h := r.byte(); h != OK_PACKET && h != EOF_PACKET {
+		return ok, ErrMalformedPacket
+	}
+	ok.AffectedRows = r.lenEncInt()
+	ok.LastInsertId = r.lenEncInt()
+	ok.Status = r.uint16()
+	ok.Warnings = r.uint16()
+	if r.err == nil && !r.eof() {
+		ok.Info = append([]byte{}, r.data[r.pos:]...)
+	}
+	return ok, r.err
+}
+
+func (ok OkPacket) Encode() []byte {
+	return ok.encode(OK_PACKET)
+}
+
+// CLIENT_DEPRECATE_EOF 时结束结果集的 OK 包, 以 0xfe 开头
+func (ok OkPacket) EncodeEOF() []byte {
+	return ok.encode(EOF_PACKET)
+}
+
+func (ok OkPacket) encode(header byte) []byte {
+	b := make([]byte, 0, 7+len(ok.Info))
+	b = append(b, header)
+	b = AppendLenEncInt(b, ok.AffectedRows)
+	b = AppendLenEncInt(b, ok.LastInsertId)
+	b = append(b, uint16Bytes(ok.Status)...)
+	b = append(b, uint16Bytes(ok.Warnings)...)
+	return append(b, ok.Info...)
+}
+
+func ParseEofPacket(data []byte) (EofPacket, error) {
+	eof := EofPacket{}
+	r := reader{data: data}
+	if h := r.byte(); h != EOF_PACKET || len(data) >= 9 {
+		return eof, ErrMalformedPacket
+	}
+	eof.Warnings = r.uint16()
+	eof.Status = r.uint16()
+	return eof, r.err
+}
+
+// 返回 OK 或 EOF 包中的服务端状态
+func (eof EofPacket) Encode() []byte {
+	b := []byte{EOF_PACKET}
+	b = append(b, uint16Bytes(eof.Warnings)...)
+	return append(b, uint16Bytes(eof.Status)...)
+}
+
+func PacketStatus(p Packet) (uint16, bool) {
+	switch {
+	case IsEofPacket(p):
+		eof, err := ParseEofPacket(p.Payload)
+		return eof.Status, err == nil
+	case IsOkPacket(p):
+		ok, err := ParseOkPacket(p.Payload)
+		return ok.Status, err == nil
+	}
+	return 0, false
+}
+
+// 使用 OK 或 EOF 包更新会话状态, 其他包不处理
+func (s *Session) Update(p Packet) {
+	// CLIENT_DEPRECATE_EOF 时不再有 EOF 包, 0xfe 开头的是 OK 包
+	if IsOkPacket(p) || s.DeprecateEOF() && isEofHeaderOk(p) {
+		if ok, err := ParseOkPacket(p.Payload); err == nil {
+			s.Status = ok.Status
+			s.trackSession(ok)
+		}
+		return
+	}
+	if status, ok := PacketStatus(p); ok {
+		s.Status = status
+	}
+}
+
+// 读取 OK 包中 info 之后的会话状态变化, 记录当前数据库是否变化
+func (s *Session) trackSession(ok OkPacket) {
+	if s.Capability&CLIENT_SESSION_TRACK == 0 || ok.Status&SERVER_SESSION_STATE_CHANGED == 0 {
+		return
+	}
+	r := reader{data: ok.Info}
+	r.lenEncBytes()
+	state := reader{data: r.lenEncBytes()}
+	for r.err == nil && state.err == nil && !state.eof() {
+		if state.byte() == SESSION_TRACK_SCHEMA {
+			s.DatabaseChanged = true
+			return
+		}
+		state.lenEncBytes()
+	}
+}
+
+func (s *Session) DeprecateEOF() bool {
+	return s.Capability&CLIENT_DEPRECATE_EOF != 0
+}
+
+// 结果集最后一行之后的包, CLIENT_DEPRECATE_EOF 时为 0xfe 开头的 OK 包, 否则为 EOF 包
+func (s *Session) IsResultSetEnd(p Packet) bool {
+	if s.DeprecateEOF() {
+		return isEofHeaderOk(p)
+	}
+	return IsEofPacket(p)
+}
+
+// 0xfe 开头的 OK 包, 数据行以 0xfe 开头时长度不小于 0xffffff
+func isEofHeaderOk(p Packet) bool {
+	return len(p.Payload) > 0 && len(p.Payload) < MAX_PAYLOAD_LEN && p.Payload[0] == EOF_PACKET
+}
+
+// 是否有未结束的事务
+func (s *Session) InTransaction() bool {
+	return s.Status&SERVER_STATUS_IN_TRANS != 0
+}
+
+// 处于自动提交模式, 并且没有未结束的事务、结果集和游标
+func (s *Session) Idle() bool {
+	return s.Status&SERVER_STATUS_AUTOCOMMIT != 0 &&
+		s.Status&(SERVER_STATUS_IN_TRANS|SERVER_MORE_RESULTS_EXISTS|SERVER_STATUS_CURSOR_EXISTS) == 0
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 转发数据包时每次最多复制 STREAM_BUFFER_SIZE 字节, 缓冲从 streamBuffers 复用
+const STREAM_BUFFER_SIZE = 16 << 10
+
+var streamBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, STREAM_BUFFER_SIZE)
+		return &buf
+	},
+}
+
+// 转发时完整读取的包和压缩帧, 按大小从 smallBuffers 或 packetBuffers 复用, 更大的直接分配
+const SMALL_BUFFER_SIZE = 512
+
+var (
+	smallBuffers = sync.Pool{
+		New: func() interface{} {
+			return new([SMALL_BUFFER_SIZE]byte)
+		},
+	}
+	packetBuffers = sync.Pool{
+		New: func() interface{} {
+			return new([STREAM_BUFFER_SIZE]byte)
+		},
+	}
+)
+
+func getBuffer(n int) []byte {
+	switch {
+	case n <= SMALL_BUFFER_SIZE:
+		return smallBuffers.Get().(*[SMALL_BUFFER_SIZE]byte)[:n]
+	case n <= STREAM_BUFFER_SIZE:
+		return packetBuffers.Get().(*[STREAM_BUFFER_SIZE]byte)[:n]
+	}
+	return make([]byte, n)
+}
+
+// 放回 getBuffer 得到的缓冲, 之后不能再使用
+func putBuffer(b []byte) {
+	switch cap(b) {
+	case SMALL_BUFFER_SIZE:
+		smallBuffers.Put((*[SMALL_BUFFER_SIZE]byte)(b[:SMALL_BUFFER_SIZE]))
+	case STREAM_BUFFER_SIZE:
+		packetBuffers.Put((*[STREAM_BUFFER_SIZE]byte)(b[:STREAM_BUFFER_SIZE]))
+	}
+}
+
+// 转发完成后放回 TransportPacket 读取的包, 之后不能再使用 Payload
+func ReleasePacket(p Packet) {
+	if p.Payload != nil {
+		putBuffer(p.Payload)
+	}
+}
+
+// 转发一个包, 数据包 (数据行, column definition) 按帧直接复制, 不在内存中保存完整的包
+// 直接复制的包返回时只有序号, Payload 为 nil; 0xfe 和 0xff 开头的 OK, EOF, ERR 包完整读取给调用方判断
+// 需要判断空包或其他包内容的地方使用 TransportPacket
+func StreamPacket(src, dst Connector) (Packet, error) {
+	s, ok := src.(*Conn)
+	if !ok {
+		return TransportPacket(src, dst)
+	}
+	d, ok := dst.(*Conn)
+	if !ok || d.compress != nil {
+		// 写入压缩连接时需要完整的包, 数据包转发后放回缓冲
+		p, err := TransportPacket(src, dst)
+		if err == nil && len(p.Payload) > 0 && p.Payload[0] != EOF_PACKET && p.Payload[0] != ERR_PACKET {
+			ReleasePacket(p)
+			p.Payload = nil
+		}
+		return p, err
+	}
+	if s.Closed() {
+		return Packet{}, fmt.Errorf("read src err: %w", ErrConnClosed)
+	}
+	if d.Closed() {
+		return Packet{}, fmt.Errorf("write dst err: %w", ErrConnClosed)
+	}
+	return s.streamTo(d)
+}
+
+func (c *Conn) streamTo(dst *Conn) (Packet, error) {
+	length, seqId, err := c.readHeader()
+	if err != nil {
+		return Packet{}, fmt.Errorf("read src err: %w", err)
+	}
+	p := Packet{SeqId: seqId}
+
+	buf := streamBuffers.Get().(*[]byte)
+	defer streamBuffers.Put(buf)
+
+	first := (*buf)[:0]
+	if length > 0 {
+		first = (*buf)[:1]
+		if _, err := io.ReadFull(c.reader(), first); err != nil {
+			c.Close()
+			return p, fmt.Errorf("read src err: read packet payload err: %w", err)
+		}
+	}
+	if length > 0 && length < MAX_PAYLOAD_LEN && (first[0] == EOF_PACKET || first[0] == ERR_PACKET) {
+		p.Payload = make([]byte, length)
+		p.Payload[0] = first[0]
+		if _, err := io.ReadFull(c.reader(), p.Payload[1:]); err != nil {
+			c.Close()
+			return p, fmt.Errorf("read src err: read packet payload err: %w", err)
+		}
+		if err := dst.WritePacket(p); err != nil {
+			return p, fmt.Errorf("write dst err: %w", err)
+		}
+		return p, nil
+	}
+
+	if err := dst.writeHeader(length, seqId); err != nil {
+		return p, fmt.Errorf("write dst err: %w", err)
+	}
+	if _, err := dst.bw.Write(first); err != nil {
+		return p, fmt.Errorf("write dst err: write packet err: %w", err)
+	}
+	if err := c.copyPayload(dst, length-len(first), *buf); err != nil {
+		return p, err
+	}
+
+	// 拆分的包, 后面的帧原样复制
+	for length == MAX_PAYLOAD_LEN {
+		if length, seqId, err = c.readHeader(); err != nil {
+			return p, fmt.Errorf("read src err: read split packet err: %w", err)
+		}
+		if err := dst.writeHeader(length, seqId); err != nil {
+			return p, fmt.Errorf("write dst err: %w", err)
+		}
+		if err := c.copyPayload(dst, length, *buf); err != nil {
+			return p, err
+		}
+	}
+	if err := dst.flushWrites(); err != nil {
+		return p, fmt.Errorf("write dst err: %w", err)
+	}
+	return p, nil
+}
+
+// 使用 buf 分段复制 length 字节的 payload
+func (c *Conn) copyPayload(dst *Conn, length int, buf []byte) error {
+	for length > 0 {
+		n := length
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err := io.ReadFull(c.reader(), buf[:n]); err != nil {
+			c.Close()
+			return fmt.Errorf("read src err: read packet payload err: %w", err)
+		}
+		if _, err := dst.bw.Write(buf[:n]); err != nil {
+			return fmt.Errorf("write dst err: write packet err: %w", err)
+		}
+		length -= n
+	}
+	return nil
+}
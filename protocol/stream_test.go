@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 大于 MAX_PAYLOAD_LEN 的数据行拆分成多个帧, 转发后与服务端发送的内容一致
+func TestStreamSplitRow(t *testing.T) {
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF}
+
+	// 0xfe 开头的数据行 (8 字节长度的字符串)
+	value := bytes.Repeat([]byte{'x'}, MAX_PAYLOAD_LEN+100)
+	row := append([]byte{0xfe, byte(len(value)), byte(len(value) >> 8), byte(len(value) >> 16), 0, 0, 0, 0, 0}, value...)
+	packets := []Packet{
+		{Payload: []byte{1}, SeqId: 1},
+		{Payload: testColumn.Payload, SeqId: 2},
+	}
+	packets = append(packets, Packet{Payload: row, SeqId: 3}.Split()...)
+	packets = append(packets, Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x03, 0, 0, 0}, SeqId: 5})
+	data := packetBytes(packets...)
+
+	server := NewBufferConn(nil, data)
+	client := NewBufferConn(nil, nil)
+	err := NewResponse(NewConn(server), COM_QUERY, session).ResponsePacket(NewConn(client))
+	assert.Nil(t, err, "response err")
+	assert.Zero(t, server.readBuffer.Len(), "response not fully read")
+	assert.True(t, bytes.Equal(data, client.writeBuffer.Bytes()), "streamed response err")
+	assert.True(t, session.InTransaction(), "status not updated")
+
+	received := readPackets(t, client.writeBuffer.Bytes())
+	assert.Len(t, received, 4, "response packets err")
+	assert.Equal(t, row, received[2].Payload, "split row err")
+}
+
+func TestStreamPacket(t *testing.T) {
+	small := Packet{Payload: []byte{1, 'x'}, SeqId: 3}
+	eof := Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x02, 0}, SeqId: 6}
+	large := Packet{Payload: append([]byte{0x10}, bytes.Repeat([]byte{'y'}, STREAM_BUFFER_SIZE*3)...), SeqId: 4}
+	// 0xff 开头的大包完整读取, 调用方需要判断 ERR
+	errPacket := Packet{Payload: append([]byte{ERR_PACKET}, bytes.Repeat([]byte{'z'}, STREAM_BUFFER_SIZE*2)...), SeqId: 5}
+	data := packetBytes(small, large, errPacket, eof)
+
+	server := NewConn(NewBufferConn(nil, data))
+	client := NewBufferConn(nil, nil)
+	dst := NewConn(client)
+
+	p, err := StreamPacket(server, dst)
+	assert.Nil(t, err, "stream small packet err")
+	assert.Nil(t, p.Payload, "data packet copied to memory")
+	assert.Equal(t, uint8(3), p.SeqId, "small packet seq err")
+
+	p, err = StreamPacket(server, dst)
+	assert.Nil(t, err, "stream large packet err")
+	assert.Nil(t, p.Payload, "large packet copied to memory")
+	assert.Equal(t, uint8(4), p.SeqId, "large packet seq err")
+
+	p, err = StreamPacket(server, dst)
+	assert.Nil(t, err, "stream err packet err")
+	assert.True(t, IsErrPacket(p), "err packet not read")
+	assert.Equal(t, errPacket.Payload, p.Payload, "err packet payload err")
+
+	p, err = StreamPacket(server, dst)
+	assert.Nil(t, err, "stream eof packet err")
+	assert.Equal(t, eof, p, "eof packet err")
+
+	assert.True(t, bytes.Equal(data, client.writeBuffer.Bytes()), "streamed data err")
+}
+
+// 写入压缩连接时完整读取, 数据包转发后放回缓冲
+func TestStreamPacketCompressed(t *testing.T) {
+	row := Packet{Payload: []byte{1, 'x'}, SeqId: 3}
+	eof := Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x02, 0}, SeqId: 4}
+	server := NewConn(NewBufferConn(nil, packetBytes(row, eof)))
+	client := NewBufferConn(nil, nil)
+	dst := newCompressConn(client)
+
+	p, err := StreamPacket(server, dst)
+	assert.Nil(t, err, "stream row err")
+	assert.Nil(t, p.Payload, "released payload returned")
+	assert.Equal(t, uint8(3), p.SeqId, "row seq err")
+
+	p, err = StreamPacket(server, dst)
+	assert.Nil(t, err, "stream eof err")
+	assert.Equal(t, eof, p, "eof packet err")
+
+	r := newCompressConn(NewBufferConn(nil, client.writeBuffer.Bytes()))
+	for _, want := range []Packet{row, eof} {
+		p, err := r.ReadPacket()
+		assert.Nil(t, err, "read packet err")
+		assert.Equal(t, want, p, "relayed packet err")
+	}
+}
+
+// 每个包单独写入的连接, 作为对比
+type unbufferedConn struct {
+	Connector
+}
+
+// 假的 mysql 返回 1000 行的结果集, 转发给 unix socket 上的客户端
+func benchmarkResultSet(b *testing.B, wrap func(Connector) Connector, compressed bool) {
+	packets := []Packet{{Payload: []byte{1}}, testColumn}
+	for i := 0; i < 1000; i++ {
+		packets = append(packets, Packet{Payload: []byte{8, 'r', 'o', 'w', '-', 'd', 'a', 't', 'a'}})
+	}
+	packets = append(packets, Packet{Payload: []byte{EOF_PACKET, 0, 0, 0x02, 0, 0, 0}})
+	for i := range packets {
+		packets[i].SeqId = uint8(i + 1)
+	}
+	data := packetBytes(packets...)
+	if compressed {
+		// 每个包一个压缩帧
+		buf := NewBufferConn(nil, nil)
+		w := newCompressConn(buf)
+		for _, p := range packets {
+			if err := w.WritePacket(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+		data = buf.writeBuffer.Bytes()
+	}
+
+	c1, c2 := unixConnPair(b)
+	go io.Copy(ioutil.Discard, c2)
+	client := wrap(NewConn(c1))
+	if compressed {
+		client = newCompressConn(c1)
+	}
+	session := &Session{Capability: CLIENT_PROTOCOL_41 | CLIENT_DEPRECATE_EOF}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server := NewConn(NewBufferConn(nil, data))
+		if compressed {
+			server = newCompressConn(NewBufferConn(nil, data))
+		}
+		if err := NewResponse(server, COM_QUERY, session).ResponsePacket(client); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResultSet(b *testing.B) {
+	benchmarkResultSet(b, func(c Connector) Connector { return c }, false)
+}
+
+func BenchmarkResultSetUnbuffered(b *testing.B) {
+	benchmarkResultSet(b, func(c Connector) Connector { return unbufferedConn{c} }, false)
+}
+
+// mysql 和客户端都使用压缩协议, 数据行完整读取后转发
+func BenchmarkResultSetCompressed(b *testing.B) {
+	benchmarkResultSet(b, func(c Connector) Connector { return c }, true)
+}
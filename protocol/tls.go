@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TLS 握手超时时间
+const tlsHandshakeTimeout = 5 * time.Second
+
+// 连接 mysql 时使用 TLS, required 为 true 时服务端不支持 SSL 会返回错误
+func NewTLSConn(c net.Conn, config *tls.Config, required bool) Connector {
+	conn := newConn(c)
+	conn.tlsConfig = config
+	conn.tlsRequired = required
+	return conn
+}
+
+// TLS 握手从连接的读缓冲开始读取
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SSLRequest 包, 与 HandshakeResponse41 的前 32 字节相同
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_connection_phase_packets_protocol_ssl_request.html
+func SSLRequestPacket(capability uint32, maxPacketSize uint32, charset uint8, seqId uint8) Packet {
+	resp := HandshakeResponse{Capability: capability | CLIENT_SSL, MaxPacketSize: maxPacketSize, Charset: charset}
+	return Packet{Payload: resp.Encode()[:32], SeqId: seqId}
+}
+
+// 是否为 SSLRequest 包
+func IsSSLRequestPacket(p Packet) bool {
+	return len(p.Payload) == 32 && binary.LittleEndian.Uint32(p.Payload)&CLIENT_SSL != 0
+}
+
+// 服务端支持时发送 SSLRequest 并升级为 TLS 连接, 返回是否已升级
+func (c *Conn) startTLS(hs Handshake, resp HandshakeResponse, seqId uint8) (bool, error) {
+	if c.tlsConfig == nil {
+		return false, nil
+	}
+	if hs.Capability&CLIENT_SSL == 0 {
+		if c.tlsRequired {
+			return false, ErrSSLNotSupported
+		}
+		return false, nil
+	}
+
+	err := c.WritePacket(SSLRequestPacket(resp.Capability, resp.MaxPacketSize, resp.Charset, seqId))
+	if err != nil {
+		return false, fmt.Errorf("send ssl request err: %w", err)
+	}
+
+	err = c.upgrade(func(conn net.Conn) *tls.Conn {
+		return tls.Client(conn, c.tlsConfig)
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 修改 HandshakeResponse41 原始包中的 capability
+func setCapability(payload []byte, capability uint32) []byte {
+	data := append([]byte{}, payload...)
+	if len(data) >= 4 {
+		binary.LittleEndian.PutUint32(data, capability)
+	}
+	return data
+}
+
+// 客户端发送 SSLRequest 后, 使用代理的证书升级为 TLS 连接
+func AcceptTLS(client Connector, config *tls.Config) error {
+	c, ok := client.(*Conn)
+	if !ok || config == nil {
+		return ErrSSLNotSupported
+	}
+
+	return c.upgrade(func(conn net.Conn) *tls.Conn {
+		return tls.Server(conn, config)
+	})
+}
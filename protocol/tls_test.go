@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 自签名证书, 服务器名为 mysql.test
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "generate key err")
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mysql.test"},
+		DNSNames:              []string{"mysql.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err, "create cert err")
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "parse cert err")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestConnectTLS(t *testing.T) {
+	cert, roots := testCertificate(t)
+	at := newSha2AuthTest(t)
+	hs, err := ParseHandshake(at.handshake.Payload)
+	assert.Nil(t, err, "parse handshake err")
+	hs.Capability |= CLIENT_SSL
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	done := make(chan []Packet, 1)
+	go func() {
+		defer c2.Close()
+		packets := []Packet{}
+		server := NewConn(c2)
+		server.WritePacket(Packet{Payload: hs.Encode()})
+		sslRequest, _ := server.ReadPacket()
+		packets = append(packets, sslRequest)
+
+		tlsConn := tls.Server(c2, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tlsConn.Handshake(); err != nil {
+			done <- packets
+			return
+		}
+		server = NewConn(tlsConn)
+		resp, _ := server.ReadPacket()
+		server.WritePacket(Packet{Payload: []byte{AUTH_MORE_DATA_PACKET, CACHING_SHA2_FULL_AUTH}, SeqId: resp.SeqId + 1})
+		password, _ := server.ReadPacket()
+		server.WritePacket(Packet{Payload: at.okPacket.Payload, SeqId: password.SeqId + 1})
+		done <- append(packets, resp, password)
+	}()
+
+	conn := NewTLSConn(c1, &tls.Config{ServerName: "mysql.test", RootCAs: roots}, true)
+	err = conn.Connect(Account{User: "proxy", Password: []byte("secret")})
+	assert.Nil(t, err, "connect err")
+	assert.True(t, IsSecure(conn), "conn not upgraded")
+
+	packets := <-done
+	assert.Len(t, packets, 3, "server packets err")
+	assert.True(t, IsSSLRequestPacket(packets[0]), "ssl request err")
+	assert.Equal(t, uint8(1), packets[0].SeqId, "ssl request seq err")
+
+	resp, err := ParseHandshakeResponse(packets[1].Payload)
+	assert.Nil(t, err, "parse response err")
+	assert.Equal(t, uint8(2), packets[1].SeqId, "response seq err")
+	assert.NotZero(t, resp.Capability&CLIENT_SSL, "response ssl flag err")
+
+	// TLS 连接上直接发送明文密码
+	assert.Equal(t, []byte("secret\x00"), packets[2].Payload, "password err")
+}
+
+func TestConnectTLSNotSupported(t *testing.T) {
+	at := newSha2AuthTest(t)
+	bconn := NewBufferConn(nil, packetBytes(at.handshake))
+
+	err := NewTLSConn(bconn, &tls.Config{}, true).Connect(Account{User: "proxy"})
+	assert.ErrorIs(t, err, ErrSSLNotSupported, "connect err")
+	assert.Zero(t, bconn.writeBuffer.Len(), "sent data without ssl")
+}